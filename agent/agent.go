@@ -0,0 +1,803 @@
+// Package agent implements the slick agent loop, so it can be embedded in other programs as well as run by the
+// slick-agent command.
+package agent
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/slickqa/slick-agent/slickClient"
+	"github.com/slickqa/slick/slickqa"
+	"golang.org/x/net/context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Options are the settings an agent is created with, they don't change when the configuration is reloaded.
+// LogFormat (text or json), LogFile, LogMaxSize and LogMaxBackups describe the logger New creates with
+// NewLogger, unless a Logger is given.  Secrets are redacted from what that logger writes, and kept from the
+// environment of commands.  The last configuration that loaded is kept in the ConfigurationCache file, see
+// LoadConfiguration.  The slick token is only sent with a configuration url on slick's grpc host, unless
+// ConfigurationAuth is set.
+type Options struct {
+	ConfigurationLocation string
+	ConfigurationCache    string
+	ConfigurationAuth     bool
+	APIKey                string
+	GrpcUrl               string
+	TLS                   slickClient.TLSOptions
+	Groups                []string
+	Debug                 bool
+	ShellCommand          string
+	ShellOpt              string
+	LogFormat             string
+	LogFile               string
+	LogMaxSize            int
+	LogMaxBackups         int
+	Logger                *zerolog.Logger
+	Secrets               *Secrets
+}
+
+// DefaultOptions returns options with the shell used for commands set appropriately for the platform.
+func DefaultOptions() Options {
+	options := Options{
+		Groups:  make([]string, 0),
+		Secrets: NewSecrets(),
+	}
+	if runtime.GOOS == "windows" {
+		options.ShellCommand = "cmd.exe"
+		options.ShellOpt = "/C"
+	} else {
+		options.ShellCommand = "/bin/bash"
+		options.ShellOpt = "-c"
+	}
+	return options
+}
+
+type Agent struct {
+	Options                Options
+	Config                 AgentConfiguration
+	Status                 AgentStatus
+	LastConfigurationCheck time.Time
+	RanTest                bool
+	Cache                  ParsedConfigurationOptions
+	Slick                  *slickClient.SlickClient
+	LastAction             *ActionResult
+	Plugins                *Plugins
+	Executor               int
+	testOutput             *CommandOutput
+	queueErrors            int
+	testContext            context.Context
+	snapshotMutex          sync.Mutex
+	snapshot               agentSnapshot
+	retired                []retiredClient
+	executorGenerations    map[int]int
+	configChanged          chan struct{}
+	control                *control
+	metrics                *Metrics
+	logger                 zerolog.Logger
+	iteration              int
+	controlAction          bool
+	unacknowledged         *ActionResult
+}
+
+// New creates an agent, loading its configuration from the location in the options and connecting to slick
+// when a grpc url is configured.
+func New(options Options) (*Agent, error) {
+	if options.Groups == nil {
+		options.Groups = make([]string, 0)
+	}
+	if options.Secrets == nil {
+		options.Secrets = NewSecrets()
+	}
+	if options.Logger == nil {
+		logger := NewLogger(options)
+		options.Logger = &logger
+	}
+	agent := &Agent{Options: options, Plugins: NewPlugins(), control: newControl(), metrics: NewMetrics(), logger: *options.Logger,
+		executorGenerations: make(map[int]int), configChanged: make(chan struct{}, 1)}
+	var err error
+	var auth slickClient.Authorizer
+	agent.Slick = optionsClient(&agent.Options)
+	if agent.Slick != nil {
+		auth = agent.Slick
+	}
+	agent.Config, agent.Cache, err = LoadConfiguration(&agent.Options, auth)
+	if err != nil {
+		if agent.Slick != nil {
+			agent.Slick.Close()
+		}
+		return nil, err
+	}
+	agent.logger.Info().Msgf("Using configuration revision %s%s", agent.Cache.Revision.Revision, fromCache(agent.Cache.Revision))
+	// published before connecting, so the client used to fetch the configuration is closed if it's replaced
+	agent.publishConfiguration()
+	agent.connectSlick()
+	agent.publishConfiguration()
+	agent.LastConfigurationCheck = time.Now()
+	return agent, nil
+}
+
+// connectSlick makes the agent's slick client match the configuration, replacing it when the grpc url, api key,
+// tls options, request timeout or retries changed.  The old client is kept when the new one can't be created,
+// and connecting is tried again the next time the configuration is checked.
+func (agent *Agent) connectSlick() {
+	current := agent.Slick
+	config := agent.Config
+	if current == nil && config.Slick.GrpcUrl == "" {
+		return
+	}
+	if current != nil && current.GrpcUrl == config.Slick.GrpcUrl && current.Token == config.APIKey &&
+		current.TLS == config.Slick.TLS && current.Timeout == agent.Cache.RequestTimeout && current.Retries == config.Slick.Retries {
+		return
+	}
+	if config.Slick.GrpcUrl == "" {
+		agent.logger.Info().Msg("No slick grpc url is configured anymore, disconnecting from slick.")
+		agent.Slick = nil
+		return
+	}
+	client, err := slickClient.CreateClient(config.Slick.GrpcUrl, config.APIKey, config.Slick.TLS,
+		agent.Cache.RequestTimeout, config.Slick.Retries)
+	if err != nil {
+		agent.logger.Error().Msgf("Error creating slick client: %s", err)
+		return
+	}
+	agent.Slick = client
+}
+
+// optionsClient connects to slick with the api key and grpc url from the options, which lets the agent log in
+// to fetch the configuration.  It returns nil when the options don't have both, or the client can't be created.
+func optionsClient(options *Options) *slickClient.SlickClient {
+	if options.GrpcUrl == "" || options.APIKey == "" {
+		return nil
+	}
+	client, err := slickClient.CreateClient(options.GrpcUrl, options.APIKey, options.TLS,
+		slickClient.DefaultRequestTimeout, slickClient.DefaultRetries)
+	if err != nil {
+		options.logger().Error().Msgf("Error creating slick client: %s", err)
+		return nil
+	}
+	return client
+}
+
+// Run runs the agent loop until a phase asks the agent to exit or the context is cancelled.  Once cancelled
+// no new tests are taken, a running test gets the configured shutdown grace period to finish before its
+// commands are killed, and the rest of the loop including cleanup runs before slick is told the agent is offline.
+// When more than one executor is configured the tests are run by executor slots, see RunExecutors.
+func (agent *Agent) Run(ctx context.Context) error {
+	testContext, killTest := context.WithCancel(context.Background())
+	defer killTest()
+	agent.testContext = testContext
+	// goroutines running alongside the loop get their own logger, the loop's changes every iteration
+	logger := agent.Options.logger().With().Str("agent", agent.Config.Slick.AgentName).Logger()
+	go agent.killTestAfterGracePeriod(ctx, testContext, killTest, logger)
+
+	if agent.Config.Control.Address != "" {
+		server, err := agent.StartControlServer()
+		if err != nil {
+			agent.logger.Error().Msgf("Unable to start the control api on %s: %s", agent.Config.Control.Address, err)
+		} else {
+			defer server.Close()
+		}
+	}
+
+	screenshotContext, stopScreenshots := context.WithCancel(ctx)
+	screenshotsDone := make(chan struct{})
+	go func() {
+		agent.runScreenShots(screenshotContext)
+		close(screenshotsDone)
+	}()
+
+	if agent.Config.Executors > 1 {
+		agent.RunExecutors(ctx, agent.Config.Executors)
+	} else {
+		for !agent.Status.ShouldExit && ctx.Err() == nil {
+			agent.RunOnce(ctx)
+		}
+		agent.reportExit(ctx)
+	}
+
+	stopScreenshots()
+	agent.Plugins.StopAll()
+	<-screenshotsDone
+	return ctx.Err()
+}
+
+// reportExit tells slick the agent is offline once its loop is done.
+func (agent *Agent) reportExit(ctx context.Context) {
+	if agent.Status.ShouldExit {
+		agent.logger.Info().Msgf("Agent %s requested to exit!", agent.Config.Slick.AgentName)
+	} else {
+		agent.logger.Info().Msgf("Agent %s is shutting down.", agent.Config.Slick.AgentName)
+	}
+	agent.Status.RunStatus = "OFFLINE"
+	agent.Status.ResultToRun = nil
+	agent.HandleStatusUpdate()
+}
+
+// killTestAfterGracePeriod waits for ctx to be cancelled, and kills the commands of a running test if it
+// hasn't finished within the shutdown grace period.
+func (agent *Agent) killTestAfterGracePeriod(ctx context.Context, testContext context.Context, killTest context.CancelFunc, logger zerolog.Logger) {
+	select {
+	case <-ctx.Done():
+	case <-testContext.Done():
+		return
+	}
+	gracePeriod := agent.currentSnapshot().Cache.ShutdownGracePeriod
+	logger.Info().Msgf("Shutdown requested, waiting up to %s for a running test to finish.", gracePeriod)
+	if sleep(testContext, gracePeriod) {
+		logger.Warn().Msgf("Shutdown grace period of %s is over, killing the running test.", gracePeriod)
+		killTest()
+	}
+}
+
+// RunOnce runs a single iteration of the agent loop, going through every phase once.
+func (agent *Agent) RunOnce(ctx context.Context) {
+	agent.Discover()
+	agent.RunSlot(ctx)
+	agent.HandleSleep(ctx)
+}
+
+// Discover reloads the configuration if needed and runs the phases that describe the agent, from loop-start
+// through broke-discovery, starting from a fresh status.
+func (agent *Agent) Discover() {
+	agent.startIteration()
+	agent.logger.Debug().Msg("Top of loop, initializing status.")
+	agent.Status = agent.DefaultStatus()
+	agent.CheckConfiguration()
+	agent.HandleLoopStart()
+	agent.HandleCheckForAction()
+	if agent.Status.Action != "" {
+		agent.HandlePerformAction()
+	}
+	agent.HandleDiscoverTestAttributes()
+	agent.HandleDiscovery()
+	agent.HandleBrokenDiscovery()
+	if agent.control.shouldExit() {
+		agent.Status.ShouldExit = true
+	}
+	agent.publishStatus()
+}
+
+// RunSlot runs the phases that get and run a test, from get-status through cleanup.  No new test is taken once
+// ctx is cancelled, or while the agent is paused through the control api.
+func (agent *Agent) RunSlot(ctx context.Context) {
+	agent.countLoop()
+	agent.HandleGetCurrentStatus()
+	agent.HandleStatusUpdate()
+	agent.RanTest = false
+	agent.Status.RanTest = false
+	if agent.Status.RunStatus == "IDLE" && ctx.Err() == nil && agent.control.takingTests() {
+		agent.HandleBeforeGetTest()
+		agent.HandleGetTest(ctx)
+		if agent.Status.ResultToRun != nil {
+			agent.RanTest = true
+			agent.Status.RanTest = true
+			agent.Status.RunStatus = "RUNNING"
+			agent.HandleStatusUpdate()
+			agent.HandleRunTest()
+		} else {
+			agent.HandleNoTest()
+		}
+		agent.HandleStatusUpdate()
+	}
+	agent.HandleCleanup()
+}
+
+func (agent *Agent) DefaultStatus() AgentStatus {
+	groups := make([]string, len(agent.Options.Groups))
+	projects := make([]*slickqa.ProjectReleaseBuildInfo, 0)
+	copy(groups, agent.Options.Groups)
+	for _, p := range agent.Config.Projects {
+		projects = append(projects, &slickqa.ProjectReleaseBuildInfo{Project: p.Name,
+			Build:   p.Build,
+			Release: p.Release})
+	}
+	return AgentStatus{
+		RunStatus:              "IDLE",
+		RanTest:                false,
+		Groups:                 groups,
+		Provides:               make([]string, 0),
+		BrokenProvides:         make([]string, 0),
+		Attributes:             make(map[string]string),
+		RequiredTestAttributes: make(map[string]string),
+		Projects:               projects,
+		AgentName:              agent.Config.Slick.AgentName,
+		LastAction:             agent.LastAction,
+	}
+}
+
+func (agent *Agent) CheckConfiguration() {
+	agent.logger.Debug().Msgf("Checking to see if we need to reload config.  Last check happened at %s", agent.LastConfigurationCheck.String())
+	if time.Now().After(agent.LastConfigurationCheck.Add(agent.Cache.CheckForConfigurationEvery)) {
+		config, cache, err := LoadConfiguration(&agent.Options, agent.authorizer())
+		agent.countConfigReload(err, cache.Revision)
+		if err == nil {
+			if cache.Revision.Revision != agent.Cache.Revision.Revision || cache.Revision.FromCache != agent.Cache.Revision.FromCache {
+				agent.logger.Info().Msgf("Using configuration revision %s%s", cache.Revision.Revision, fromCache(cache.Revision))
+			}
+			for _, change := range diffConfiguration(agent.Config, config) {
+				agent.logger.Info().Msgf("Configuration changed: %s", change)
+			}
+			agent.Config = config
+			agent.Cache = cache
+			agent.connectSlick()
+			agent.publishConfiguration()
+		} else {
+			agent.logger.Error().Msgf("Error loading configuration, using old configuration: %s", err.Error())
+		}
+		agent.LastConfigurationCheck = time.Now()
+	}
+	agent.Status.Configuration = agent.Cache.Revision
+	if agent.Config.Groups != nil && len(agent.Config.Groups) > 0 {
+		var groups []string
+		groups = append(groups, agent.Options.Groups...)
+		groups = append(groups, agent.Config.Groups...)
+		agent.Status.Groups = groups
+	}
+}
+
+// phaseApplies evaluates the phase's when expression, logging why the phase is skipped when it's false.
+func (agent *Agent) phaseApplies(name string, phase *PhaseConfiguration) (bool, error) {
+	applies, explanation, err := phase.Applies(&agent.Status)
+	if err != nil {
+		agent.logger.Error().Str("phase", name).Msgf("Skipping %s phase, unable to evaluate its when: %s", phase.Source(), err)
+	} else if !applies {
+		agent.logger.Debug().Str("phase", name).Msgf("Skipping %s phase, when %#v is false with %s", phase.Source(), phase.When, explanation)
+	}
+	return applies, err
+}
+
+func fromCache(revision ConfigurationRevision) string {
+	if revision.FromCache {
+		return " from the configuration cache"
+	}
+	return ""
+}
+
+// applyPhase applies a single phase configuration from the named phase list to the agent's status, using the
+// phase's own timeout or the default from the timeouts section of the configuration.  The output of run-test
+// commands is collected for the whole test so it can be attached to the result.  A phase whose when expression
+// is false is skipped.
+func (agent *Agent) applyPhase(name string, phase *PhaseConfiguration, staticVar *string, staticArray *[]string, staticMap *map[string]string) error {
+	if applies, err := agent.phaseApplies(name, phase); !applies {
+		return err
+	}
+	return agent.runPhase(name, phase, staticVar, staticArray, staticMap)
+}
+
+// runPhase is applyPhase for a phase whose when expression the caller has already checked.
+func (agent *Agent) runPhase(name string, phase *PhaseConfiguration, staticVar *string, staticArray *[]string, staticMap *map[string]string) error {
+	timeout := agent.Cache.Timeouts[name]
+	if phase.Timeout != "" {
+		d, err := time.ParseDuration(phase.Timeout)
+		if err == nil {
+			timeout = d
+		} else {
+			agent.logger.Warn().Msgf("Using default timeout of %s for %s phase, Error in timeout %#v: %s", timeout, name, phase.Timeout, err.Error())
+		}
+	}
+	output := agent.testOutput
+	if name != "run-test" || output == nil {
+		output = NewCommandOutput(agent.logger, name, agent.Config.MaxCommandOutput)
+	}
+	ctx := context.Background()
+	if name == "run-test" && agent.testContext != nil {
+		ctx = agent.testContext
+	}
+	logger := agent.logger.With().Str("phase", name).Logger()
+	ctx = logger.WithContext(ctx)
+	var err error
+	start := time.Now()
+	if phase.Plugin != "" {
+		err = agent.Plugins.Apply(ctx, &agent.Options, name, phase.Plugin, &agent.Status, timeout, staticVar, staticArray, staticMap)
+	} else {
+		err = phase.ApplyToStatus(ctx, &agent.Options, &agent.Status, timeout, output, staticVar, staticArray, staticMap)
+	}
+	output.Flush()
+	agent.observePhase(name, phase, time.Since(start), err)
+	return err
+}
+
+func (agent *Agent) HandleLoopStart() {
+	agent.logger.Debug().Msgf("Inside HandleLoopStart, there are %d configs to process.", len(agent.Config.LoopStart))
+	for _, phase := range agent.Config.LoopStart {
+		agent.applyPhase("loop-start", &phase, nil, nil, nil)
+	}
+}
+
+func (agent *Agent) HandleCheckForAction() {
+	agent.logger.Debug().Msgf("Inside HandleCheckForAction, there are %d configs to process.", len(agent.Config.CheckForAction))
+	agent.Status.Action, agent.Status.ActionParameter = agent.queuedAction()
+	// an action from the control api waits for slick's queue to be empty, so acknowledging it can't clear
+	// an action queued in slick
+	agent.controlAction = false
+	if agent.Status.Action == "" {
+		if action, ok := agent.control.nextAction(); ok {
+			agent.Status.Action = action.Name
+			agent.Status.ActionParameter = action.Parameter
+			agent.controlAction = true
+		}
+	}
+	for _, phase := range agent.Config.CheckForAction {
+		agent.applyPhase("check-for-action", &phase, &agent.Status.Action, nil, nil)
+	}
+}
+
+// HandleExecutorAction performs the action queued in slick for an executor's own name, since slick only knows the
+// agent by its executors' names.  The check-for-action phases and actions from the control api are handled
+// once for every executor by the agent running discovery.
+func (agent *Agent) HandleExecutorAction() {
+	action, parameter := agent.queuedAction()
+	if action == "" {
+		return
+	}
+	agent.Status.Action = action
+	agent.Status.ActionParameter = parameter
+	agent.controlAction = false
+	agent.HandlePerformAction()
+}
+
+// queuedAction returns the action and parameter queued in slick for the agent's name, empty when there's none
+// or slick can't be asked.
+func (agent *Agent) queuedAction() (string, string) {
+	if agent.Slick == nil {
+		return "", ""
+	}
+	resp, err := agent.Slick.Agents.GetQueuedAction(context.Background(), &slickqa.AgentId{Company: agent.Config.Company, Name: agent.Config.Slick.AgentName})
+	if err != nil {
+		agent.logger.Error().Msgf("Problem occurred while trying to get queued action from slick: %s", err.Error())
+		return "", ""
+	}
+	if agent.unacknowledged != nil && (agent.unacknowledged.Name != resp.Action || agent.unacknowledged.Parameter != resp.ActionParameter) {
+		// the action that couldn't be cleared is gone, so the next one like it was queued again
+		agent.unacknowledged = nil
+	}
+	return resp.Action, resp.ActionParameter
+}
+
+func (agent *Agent) HandlePerformAction() {
+	agent.logger.Debug().Msgf("Inside HandlePerformAction, Action: %#v Parameter: %#v", agent.Status.Action, agent.Status.ActionParameter)
+	// slick returns an action again when clearing it failed, which doesn't mean it should be performed twice
+	if !agent.controlAction && agent.unacknowledged != nil && agent.unacknowledged.Name == agent.Status.Action && agent.unacknowledged.Parameter == agent.Status.ActionParameter {
+		agent.logger.Info().Msgf("Action %#v with parameter %#v was already performed, clearing it again.", agent.Status.Action, agent.Status.ActionParameter)
+		agent.AcknowledgeAction()
+		return
+	}
+	config, ok := agent.Config.ActionMap[agent.Status.Action]
+	if !ok {
+		agent.logger.Error().Msgf("Unable to find action %#v in action map %+v from configuration value action-map from %s", agent.Status.Action, agent.Config.ActionMap, agent.Options.ConfigurationLocation)
+		// it's still acknowledged, or slick would keep asking for an action the agent can't perform
+		result := &ActionResult{
+			Name:      agent.Status.Action,
+			Parameter: agent.Status.ActionParameter,
+			Success:   false,
+			Error:     fmt.Sprintf("unknown action %#v, it isn't in the action-map", agent.Status.Action),
+			Duration:  "0s",
+		}
+		agent.LastAction = result
+		agent.Status.LastAction = result
+		agent.AcknowledgeAction()
+		return
+	}
+	if applies, _ := agent.phaseApplies("action-map", &config.PhaseConfiguration); !applies {
+		agent.logger.Info().Msgf("Not performing action %#v with parameter %#v, its when is false.", agent.Status.Action, agent.Status.ActionParameter)
+		agent.AcknowledgeAction()
+		return
+	}
+	start := time.Now()
+	err := agent.runPhase("action-map", &config.PhaseConfiguration, nil, nil, nil)
+	result := &ActionResult{
+		Name:      agent.Status.Action,
+		Parameter: agent.Status.ActionParameter,
+		Success:   err == nil,
+		Duration:  time.Since(start).String(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		agent.logger.Error().Msgf("Action %#v failed after %s: %s", result.Name, result.Duration, result.Error)
+	} else {
+		agent.logger.Info().Msgf("Action %#v finished successfully after %s", result.Name, result.Duration)
+	}
+	agent.LastAction = result
+	agent.Status.LastAction = result
+
+	if err == nil {
+		for _, phase := range config.OnSuccess {
+			agent.applyPhase("on-success", &phase, nil, nil, nil)
+		}
+	} else {
+		for _, phase := range config.OnFailure {
+			agent.applyPhase("on-failure", &phase, nil, nil, nil)
+		}
+	}
+	agent.AcknowledgeAction()
+}
+
+// AcknowledgeAction clears the queued action in slick, so it isn't returned again by the next check for action.
+// Actions requested through the control api were never queued in slick, so there is nothing to clear.  An
+// action that couldn't be cleared is remembered, so it isn't performed again when slick returns it.
+func (agent *Agent) AcknowledgeAction() {
+	agent.unacknowledged = nil
+	if agent.Slick == nil || agent.controlAction {
+		return
+	}
+	_, err := agent.Slick.Agents.AddQueuedAction(context.Background(), &slickqa.AgentQueuedAction{
+		Id: &slickqa.AgentId{Company: agent.Config.Company, Name: agent.Config.Slick.AgentName},
+	})
+	if err != nil {
+		agent.logger.Error().Msgf("Problem occurred while trying to clear action %#v in slick: %s", agent.Status.Action, err.Error())
+		agent.unacknowledged = &ActionResult{Name: agent.Status.Action, Parameter: agent.Status.ActionParameter}
+	}
+}
+
+func (agent *Agent) HandleDiscoverTestAttributes() {
+	agent.logger.Debug().Msgf("Inside HandleDiscoverTestAttributes, there are %d configs to process.", len(agent.Config.TestAttributeDiscovery))
+	for _, phase := range agent.Config.TestAttributeDiscovery {
+		agent.applyPhase("test-attribute-discovery", &phase, nil, nil, &agent.Status.RequiredTestAttributes)
+	}
+}
+
+func (agent *Agent) HandleDiscovery() {
+	agent.logger.Debug().Msgf("Inside HandleDiscovery, there are %d configs to process.", len(agent.Config.Discovery))
+	for _, phase := range agent.Config.Discovery {
+		agent.applyPhase("discovery", &phase, nil, &agent.Status.Provides, nil)
+	}
+}
+
+func (agent *Agent) HandleBrokenDiscovery() {
+	agent.logger.Debug().Msgf("Inside HandleBrokenDiscovery, there are %d configs to process.", len(agent.Config.BrokenDiscovery))
+	for _, phase := range agent.Config.BrokenDiscovery {
+		agent.applyPhase("broke-discovery", &phase, nil, &agent.Status.BrokenProvides, nil)
+	}
+}
+
+func (agent *Agent) HandleStatusUpdate() {
+	agent.logger.Debug().Msgf("Inside HandleStatusUpdate, there are %d configs to process.", len(agent.Config.UpdateStatus))
+	if agent.Slick != nil {
+		connection := agent.Slick.Connection()
+		agent.Status.SlickConnection = &connection
+	}
+	for _, phase := range agent.Config.UpdateStatus {
+		agent.applyPhase("update-status", &phase, nil, nil, nil)
+	}
+	// update slick
+	if agent.Slick != nil {
+		var currentTest slickqa.AgentCurrentTest
+		if agent.Status.ResultToRun != nil {
+			testInfo := agent.Status.ResultToRun.TestcaseInfo()
+			testUrl := agent.Config.Slick.BaseUrl + "/testruns/" + testInfo.TestrunId + "?result=" + testInfo.Id
+			currentTest = slickqa.AgentCurrentTest{
+				Name:         testInfo.Name,
+				AutomationId: testInfo.AutomationId,
+				Url:          testUrl,
+			}
+
+		}
+		_, err := agent.Slick.Agents.UpdateStatus(context.Background(), &slickqa.AgentStatusUpdate{
+			Id: &slickqa.AgentId{Company: agent.Config.Company, Name: agent.Status.AgentName},
+			Status: &slickqa.AgentStatus{
+				Projects:    agent.Status.Projects,
+				RunStatus:   agent.Status.RunStatus,
+				CurrentTest: &currentTest,
+				Groups:      agent.Status.Groups,
+			},
+		})
+		if err != nil {
+			// the client re-connects on its own, the status is sent again next loop
+			agent.logger.Error().Msgf("Error updating the status of the agent in slick: %s", err)
+		}
+	}
+	agent.publishStatus()
+}
+
+func (agent *Agent) HandleGetCurrentStatus() {
+	agent.logger.Debug().Msgf("Inside HandleGetCurrentStatus, there are %d configs to process.", len(agent.Config.GetStatus))
+	if agent.Slick != nil {
+		resp, err := agent.Slick.Agents.GetAgentRunStatus(context.Background(), &slickqa.AgentId{Company: agent.Config.Company, Name: agent.Config.Slick.AgentName})
+		if err == nil {
+			agent.Status.RunStatus = resp.RunStatus
+		} else {
+			agent.logger.Error().Msgf("Problem occurred while trying to get run status from slick: %s", err.Error())
+		}
+	}
+	for _, phase := range agent.Config.GetStatus {
+		agent.applyPhase("get-status", &phase, &agent.Status.RunStatus, nil, nil)
+	}
+}
+
+func (agent *Agent) HandleBeforeGetTest() {
+	agent.logger.Debug().Msgf("Inside HandleBeforeGetTest, there are %d configs to process.", len(agent.Config.BeforeGetTest))
+	for _, phase := range agent.Config.BeforeGetTest {
+		agent.applyPhase("before-get-test", &phase, nil, nil, nil)
+	}
+}
+
+// RequestResultFromSlickQueue asks the queue slick.queue names for a result matching the query.  A nil result
+// with a nil error means the queue is empty.  A result that can't be parsed is finished as BROKEN_TEST, since
+// it has already been taken off the queue.
+func (agent *Agent) RequestResultFromSlickQueue(ctx context.Context, query map[string]interface{}) (*Result, error) {
+	agent.logger.Debug().Msgf("Requesting result from the queue of %s with query: %+v", agent.Config.Slick.BaseUrl, query)
+	queue, err := slickClient.CreateResultQueue(agent.Config.Slick.Queue, agent.rest())
+	if err != nil {
+		agent.logger.Error().Msgf("Unable to request a test to run from slick: %s", err.Error())
+		agent.countQueuePoll("error")
+		return nil, err
+	}
+	result, err := queue.NextResult(ctx, agent.Config.Slick.AgentName, query)
+	if unusable, ok := err.(*slickClient.UnusableResultError); ok {
+		agent.countQueuePoll("error")
+		agent.logger.Error().Msgf("Unable to use result from slick's queue: %s", err.Error())
+		if unusable.Id != "" {
+			agent.finishResult(unusable.Id, "BROKEN_TEST", "agent was unable to use the result: "+err.Error(), 0)
+		}
+		return nil, err
+	} else if err != nil {
+		agent.logger.Error().Msgf("Error requesting a test to run from slick: %s", err.Error())
+		agent.countQueuePoll("error")
+		return nil, err
+	}
+	if result == nil {
+		agent.countQueuePoll("empty")
+		agent.logger.Debug().Msg("Slick's queue had no result for the agent.")
+		return nil, nil
+	}
+	agent.countQueuePoll("result")
+	return result, nil
+}
+
+// rest returns a client for slick's REST api using the current configuration.
+func (agent *Agent) rest() *slickClient.SlickRestClient {
+	return slickClient.CreateRestClient(agent.Config.Slick.BaseUrl, agent.authorizer(), agent.Cache.RequestTimeout, agent.Config.Slick.Retries)
+}
+
+// authorizer returns the slick client to authenticate http requests with, or nil if there isn't one, since
+// logging in with the api key happens over grpc.
+func (agent *Agent) authorizer() slickClient.Authorizer {
+	if agent.Slick == nil || agent.Config.APIKey == "" {
+		return nil
+	}
+	return agent.Slick
+}
+
+// HandleGetTest asks slick's queue for a test, and runs the get-test phases.  Waiting for slick to come back
+// stops when ctx is cancelled.
+func (agent *Agent) HandleGetTest(ctx context.Context) {
+	agent.logger.Debug().Msgf("Inside HandleGetTest, there are %d configs to process.", len(agent.Config.GetTest))
+	if agent.Config.Slick.BaseUrl != "" {
+		// first get the test from slick, then call everything else
+		var err, queueErr error
+		query := make(map[string]interface{})
+		query["provides"] = agent.Status.getNonBrokenProvides()
+		for key, value := range agent.Status.RequiredTestAttributes {
+			query[key] = value
+		}
+
+		if len(agent.Status.Projects) > 0 {
+			for _, project := range agent.Status.Projects {
+				projectQuery := query
+				projectQuery["project"] = project.Project
+				if project.Release != "" {
+					projectQuery["release"] = project.Release
+				}
+				if project.Build != "" {
+					projectQuery["build"] = project.Build
+				}
+				agent.Status.ResultToRun, err = agent.RequestResultFromSlickQueue(ctx, projectQuery)
+				if err != nil {
+					queueErr = err
+				}
+				if agent.Status.ResultToRun != nil || ctx.Err() != nil {
+					break
+				}
+			}
+		} else {
+			agent.Status.ResultToRun, queueErr = agent.RequestResultFromSlickQueue(ctx, query)
+		}
+
+		// count the polls in a row that failed, so no-test phases can tell slick being down from an empty queue
+		if queueErr != nil && agent.Status.ResultToRun == nil {
+			agent.queueErrors++
+		} else {
+			agent.queueErrors = 0
+		}
+		agent.Status.SlickQueueErrors = agent.queueErrors
+	}
+
+	// TODO add a grpc queue to slickClient.CreateResultQueue once slick's grpc api has a results queue
+	for _, phase := range agent.Config.GetTest {
+		agent.applyPhase("get-test", &phase, nil, nil, nil)
+	}
+}
+
+func (agent *Agent) HandleRunTest() {
+	agent.logger.Debug().Msgf("Inside HandleRunTest, there are %d configs to process.  Current Test:\n%+v", len(agent.Config.RunTest), agent.Status.ResultToRun)
+	result := agent.Status.ResultToRun
+	testInfo := result.TestcaseInfo()
+	loopLogger := agent.logger
+	defer func() { agent.logger = loopLogger }()
+	agent.logger = agent.logger.With().
+		Str("resultId", testInfo.Id).
+		Str("testrunId", testInfo.TestrunId).
+		Str("correlationId", newCorrelationId()).
+		Logger()
+	agent.logger.Info().Msgf("Running result: %+v", testInfo)
+	start := time.Now()
+	var phaseErr error
+	// only a timeout of this test's run-test phases times it out, not one left over from another phase
+	agent.Status.PhaseTimeout = ""
+	agent.testOutput = NewCommandOutput(agent.logger, "run-test", agent.Config.MaxCommandOutput)
+	for _, phase := range agent.Config.RunTest {
+		err := agent.applyPhase("run-test", &phase, nil, nil, nil)
+		if err != nil && phaseErr == nil {
+			phaseErr = err
+		}
+	}
+	runLength := time.Since(start)
+	if agent.testOutput.Len() > 0 {
+		agent.uploadTestOutput(agent.testOutput)
+	}
+	agent.testOutput = nil
+	if agent.Status.ResultToRun == nil {
+		// a command phase cleared the result, but it still has to be finished
+		agent.Status.ResultToRun = result
+	}
+	status := agent.Status.ResultToRun.Status
+	reason := agent.Status.ResultToRun.Reason
+	testReported := status != "" && status != "NO_RESULT"
+	if agent.Status.PhaseTimeout != "" {
+		agent.logger.Warn().Msgf("Test timed out: %s", agent.Status.PhaseTimeout)
+		status = "TIMED_OUT"
+		reason = "Test timed out: " + agent.Status.PhaseTimeout
+	} else if !testReported && phaseErr != nil {
+		status = "BROKEN_TEST"
+		reason = fmt.Sprintf("run-test phase failed without reporting a status: %s", phaseErr.Error())
+	} else if !testReported {
+		status = "UNKNOWN"
+		reason = "run-test phases finished without reporting a status"
+	}
+	agent.logger.Info().Msgf("Result of test: %s", status)
+	agent.countTest(status)
+
+	if agent.Config.Slick.LeaveReportingToTest && testReported && agent.Status.PhaseTimeout == "" {
+		agent.logger.Debug().Msgf("Test reported a status of %s itself, leaving the result in slick alone.", status)
+		return
+	}
+	agent.ReportTestResult(status, reason, runLength)
+}
+
+func (agent *Agent) HandleNoTest() {
+	agent.logger.Debug().Msgf("Inside HandleNoTest, there are %d configs to process.", len(agent.Config.NoTest))
+	for _, phase := range agent.Config.NoTest {
+		agent.applyPhase("no-test", &phase, nil, nil, nil)
+	}
+}
+
+func (agent *Agent) HandleCleanup() {
+	agent.logger.Debug().Msgf("Inside HandleCleanup, there are %d configs to process.", len(agent.Config.Cleanup))
+	for _, phase := range agent.Config.Cleanup {
+		agent.applyPhase("cleanup", &phase, nil, nil, nil)
+	}
+}
+
+func (agent *Agent) HandleSleep(ctx context.Context) {
+	if agent.RanTest {
+		agent.logger.Debug().Msgf("HandleSleep: After a test, sleeping %s", agent.Cache.Sleep.AfterTest)
+		sleep(ctx, agent.Cache.Sleep.AfterTest)
+	} else {
+		agent.logger.Debug().Msgf("HandleSleep: No test ran, sleeping %s", agent.Cache.Sleep.NoTest)
+		sleep(ctx, agent.Cache.Sleep.NoTest)
+	}
+}
+
+// sleep waits for the duration, returning false early if the context is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
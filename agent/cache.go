@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ConfigurationRevision says which configuration the agent is using: the revision is the start of the sha256
+// of its content, and FromCache is set when it came from the configuration cache because the configuration
+// location couldn't be loaded.  Loaded is when it was last loaded.
+type ConfigurationRevision struct {
+	Revision  string    `json:"revision,omitempty"`
+	FromCache bool      `json:"fromCache"`
+	Loaded    time.Time `json:"loaded"`
+}
+
+// cachedConfiguration is the content of a configuration, with what is needed to ask the server whether it
+// changed.  The last one that loaded is kept in the configuration cache file.
+type cachedConfiguration struct {
+	Location     string    `json:"location"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Saved        time.Time `json:"saved"`
+	Content      string    `json:"content"`
+}
+
+// DefaultConfigurationCache returns the cache file for a configuration location, one per location in the
+// user's cache directory so agents with different configurations don't share it.
+func DefaultConfigurationCache(location string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(location))
+	return filepath.Join(dir, "slick-agent", "configuration-"+hex.EncodeToString(sum[:6])+".json")
+}
+
+func (cached *cachedConfiguration) revision() string {
+	sum := sha256.Sum256([]byte(cached.Content))
+	return hex.EncodeToString(sum[:6])
+}
+
+// readConfigurationCache returns the configuration in the cache file from the options, or nil when there is
+// no cache, or it's for a different location.
+func readConfigurationCache(options *Options) *cachedConfiguration {
+	if options.ConfigurationCache == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(options.ConfigurationCache)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			options.logger().Warn().Msgf("Unable to read configuration cache %s: %s", options.ConfigurationCache, err)
+		}
+		return nil
+	}
+	var cached cachedConfiguration
+	if err = json.Unmarshal(content, &cached); err != nil {
+		options.logger().Warn().Msgf("Ignoring configuration cache %s: %s", options.ConfigurationCache, err)
+		return nil
+	}
+	if cached.Location != options.ConfigurationLocation {
+		return nil
+	}
+	return &cached
+}
+
+// writeConfigurationCache saves the configuration to the cache file from the options.  It's only readable by
+// the agent's user, since it can hold the api key.
+func writeConfigurationCache(options *Options, cached *cachedConfiguration) {
+	if options.ConfigurationCache == "" {
+		return
+	}
+	cached.Saved = time.Now()
+	content, err := json.Marshal(cached)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(options.ConfigurationCache), 0700)
+	}
+	if err == nil {
+		// written next to the cache and renamed, so an agent stopped half way through doesn't leave half a file
+		temp := options.ConfigurationCache + ".tmp"
+		err = ioutil.WriteFile(temp, content, 0600)
+		if err == nil {
+			err = os.Rename(temp, options.ConfigurationCache)
+		}
+	}
+	if err != nil {
+		options.logger().Warn().Msgf("Unable to write configuration cache %s: %s", options.ConfigurationCache, err)
+		return
+	}
+	options.logger().Debug().Msgf("Saved configuration revision %s to %s", cached.revision(), options.ConfigurationCache)
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ErrCommandTimeout is returned by runCommand when the command did not finish within its timeout.
+var ErrCommandTimeout = errors.New("command timed out")
+
+// ErrCommandKilled is returned by runCommand when the command was killed because its context was cancelled.
+var ErrCommandKilled = errors.New("command killed because the agent is shutting down")
+
+// outputDrainTime is how long runCommand keeps copying output after the command exits, for what it wrote just
+// before exiting.  Processes it left running in the background can hold the output open much longer.
+const outputDrainTime = 200 * time.Millisecond
+
+// runCommand runs the command in its own process group, killing the whole group if it does not finish
+// within the timeout or the context is cancelled.  A timeout of zero or less waits forever.  The command's
+// stdout and stderr are written to output when it isn't nil.
+func runCommand(ctx context.Context, cmd *exec.Cmd, timeout time.Duration, output io.Writer) error {
+	setProcessGroup(cmd)
+	// the pipe is made here instead of by os/exec, whose Wait doesn't return until every process holding the
+	// pipe exits, background processes the command started included
+	var copied chan struct{}
+	var writer *detachableWriter
+	if output != nil {
+		reader, pipe, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		cmd.Stdout = pipe
+		cmd.Stderr = pipe
+		err = cmd.Start()
+		pipe.Close()
+		if err != nil {
+			reader.Close()
+			return err
+		}
+		writer = &detachableWriter{out: output}
+		copied = make(chan struct{})
+		go func() {
+			io.Copy(writer, reader)
+			reader.Close()
+			close(copied)
+		}()
+	} else if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		if writer == nil {
+			return
+		}
+		select {
+		case <-copied:
+		case <-time.After(outputDrainTime):
+			// a background process still has the output open, it keeps being read so the process doesn't get
+			// SIGPIPE, but none of it goes to output once runCommand returns
+			loggerFrom(ctx, nil).Debug().Msg("A process the command started in the background still has its output open, ignoring what it writes.")
+		}
+		writer.detach()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-expired:
+		if err := killProcessGroup(cmd); err != nil {
+			loggerFrom(ctx, nil).Error().Msg(err.Error())
+		}
+		<-done
+		return ErrCommandTimeout
+	case <-ctx.Done():
+		if err := killProcessGroup(cmd); err != nil {
+			loggerFrom(ctx, nil).Error().Msg(err.Error())
+		}
+		<-done
+		return ErrCommandKilled
+	}
+}
+
+// detachableWriter writes to out until it's detached, and discards what's written after that.
+type detachableWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (w *detachableWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.out == nil {
+		return ioutil.Discard.Write(p)
+	}
+	return w.out.Write(p)
+}
+
+func (w *detachableWriter) detach() {
+	w.mutex.Lock()
+	w.out = nil
+	w.mutex.Unlock()
+}
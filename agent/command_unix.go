@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	// a negative pid signals every process in the group
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("unable to kill process group %d: %s", cmd.Process.Pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		command  string
+		timeout  time.Duration
+		output   string
+		err      error
+		finishIn time.Duration
+	}{
+		{`echo hi`, 0, "hi\n", nil, time.Second},
+		{`echo out; echo err 1>&2; exit 3`, 0, "out\nerr\n", &exec.ExitError{}, time.Second},
+		// the command finishes once the shell does, without waiting for what it left running
+		{`sleep 5 & echo hi`, 0, "hi\n", nil, time.Second},
+		{`(sleep 1; echo late) & echo hi`, 0, "hi\n", nil, time.Second},
+		{`echo hi; sleep 5`, 200 * time.Millisecond, "hi\n", ErrCommandTimeout, time.Second},
+	}
+	for _, test := range tests {
+		var output bytes.Buffer
+		start := time.Now()
+		err := runCommand(context.Background(), exec.Command("/bin/sh", "-c", test.command), test.timeout, &output)
+		took := time.Since(start)
+		if _, exitError := test.err.(*exec.ExitError); exitError {
+			if _, ok := err.(*exec.ExitError); !ok {
+				t.Errorf("%s: expected an exit error, got %v", test.command, err)
+			}
+		} else if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.command, test.err, err)
+		}
+		if output.String() != test.output {
+			t.Errorf("%s: expected output %#v, got %#v", test.command, test.output, output.String())
+		}
+		if took > test.finishIn {
+			t.Errorf("%s: took %s, expected less than %s", test.command, took, test.finishIn)
+		}
+	}
+}
+
+func TestApplyCommandWithBackgroundProcess(t *testing.T) {
+	options := DefaultOptions()
+	options.ShellCommand = "/bin/sh"
+	phase := PhaseConfiguration{Command: "sleep 5 & echo started"}
+	var output bytes.Buffer
+	status := AgentStatus{}
+	start := time.Now()
+	if err := phase.ApplyToStatus(context.Background(), &options, &status, 0, &output, nil, nil, nil); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %s waiting for the background process", took)
+	}
+	if !strings.Contains(output.String(), "started") {
+		t.Errorf("expected the output to contain started, got %#v", output.String())
+	}
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	// taskkill /T takes care of the child processes, which Process.Kill would leave running
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", pid).Run(); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("unable to kill process tree %s, killed just the process: %s", pid, err)
+	}
+	return nil
+}
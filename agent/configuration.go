@@ -0,0 +1,361 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/slickqa/slick-agent/slickClient"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ProjectReleaseBuild struct {
+	Name    string `json:"name" yaml:"name"`
+	Release string `json:"release,omitempty" yaml:"release,omitempty"`
+	Build   string `json:"build,omitempty" yaml:"build,omitempty"`
+}
+
+type AgentConfiguration struct {
+	Company                    string                         `yaml:"company,omitempty"`
+	APIKey                     string                         `yaml:"api-key,omitempty"`
+	Groups                     []string                       `yaml:"groups,omitempty"`
+	Projects                   []ProjectReleaseBuild          `yaml:"projects,omitempty"`
+	LoopStart                  []PhaseConfiguration           `yaml:"loop-start,omitempty"`
+	CheckForAction             []PhaseConfiguration           `yaml:"check-for-action,omitempty"`
+	TestAttributeDiscovery     []PhaseConfiguration           `yaml:"test-attribute-discovery,omitempty"`
+	Discovery                  []PhaseConfiguration           `yaml:"discovery,omitempty"`
+	BrokenDiscovery            []PhaseConfiguration           `yaml:"broke-discovery,omitempty"`
+	GetStatus                  []PhaseConfiguration           `yaml:"get-status,omitempty"`
+	UpdateStatus               []PhaseConfiguration           `yaml:"update-status,omitempty"`
+	RunTest                    []PhaseConfiguration           `yaml:"run-test,omitempty"`
+	NoTest                     []PhaseConfiguration           `yaml:"no-test,omitempty"`
+	Cleanup                    []PhaseConfiguration           `yaml:"cleanup,omitempty"`
+	ActionMap                  map[string]ActionConfiguration `yaml:"action-map,omitempty"`
+	BeforeGetTest              []PhaseConfiguration           `yaml:"before-get-test,omitempty"`
+	GetTest                    []PhaseConfiguration           `yaml:"get-test,omitempty"`
+	Slick                      SlickConfiguration             `yaml:"slick,omitempty"`
+	CheckForConfigurationEvery string                         `yaml:"check-for-configuration-every,omitempty"`
+	Sleep                      SleepConfiguration             `yaml:"sleep,omitempty"`
+	Timeouts                   map[string]string              `yaml:"timeouts,omitempty"`
+	MaxCommandOutput           int                            `yaml:"max-command-output,omitempty"`
+	ShutdownGracePeriod        string                         `yaml:"shutdown-grace-period,omitempty"`
+	Executors                  int                            `yaml:"executors,omitempty"`
+	Control                    ControlConfiguration           `yaml:"control,omitempty"`
+	Secrets                    SecretsConfiguration           `yaml:"secrets,omitempty"`
+}
+
+type ParsedConfigurationOptions struct {
+	Sleep                      ParsedSleepOptions
+	CheckForConfigurationEvery time.Duration
+	Timeouts                   map[string]time.Duration
+	ShutdownGracePeriod        time.Duration
+	RequestTimeout             time.Duration
+	Revision                   ConfigurationRevision
+}
+
+type ParsedSleepOptions struct {
+	AfterTest time.Duration
+	NoTest    time.Duration
+}
+
+type SlickConfiguration struct {
+	BaseUrl              string                 `yaml:"base-url"`
+	GrpcUrl              string                 `yaml:"grpc-url"`
+	AgentName            string                 `yaml:"agent-name"`
+	LeaveReportingToTest bool                   `yaml:"leave-reporting-to-test,omitempty"`
+	Queue                string                 `yaml:"queue,omitempty"`
+	RequestTimeout       string                 `yaml:"request-timeout,omitempty"`
+	Retries              int                    `yaml:"retries"`
+	TLS                  slickClient.TLSOptions `yaml:"tls,omitempty"`
+}
+
+type ActionConfiguration struct {
+	PhaseConfiguration `yaml:",inline"`
+	OnSuccess          []PhaseConfiguration `yaml:"on-success,omitempty"`
+	OnFailure          []PhaseConfiguration `yaml:"on-failure,omitempty"`
+}
+
+type SleepConfiguration struct {
+	AfterTest string `yaml:"after-test,omitempty"`
+	NoTest    string `yaml:"no-test,omitempty"`
+}
+
+func DefaultConfiguration() (AgentConfiguration, ParsedConfigurationOptions) {
+	return AgentConfiguration{
+		CheckForConfigurationEvery: "5s",
+		Sleep: SleepConfiguration{
+			AfterTest: "500ms",
+			NoTest:    "2s",
+		},
+		Slick: SlickConfiguration{
+			RequestTimeout: "30s",
+			Retries:        slickClient.DefaultRetries,
+		},
+		ShutdownGracePeriod: "5m",
+	}, ParsedConfigurationOptions{
+		CheckForConfigurationEvery: 5 * time.Second,
+		Sleep: ParsedSleepOptions{
+			AfterTest: 500 * time.Millisecond,
+			NoTest:    2 * time.Second,
+		},
+		Timeouts:            make(map[string]time.Duration),
+		ShutdownGracePeriod: 5 * time.Minute,
+		RequestTimeout:      slickClient.DefaultRequestTimeout,
+	}
+}
+
+// LoadConfiguration reads the configuration from the file or url in the options, using auth to authenticate
+// the request when the configuration comes from a url and auth isn't nil.  Every configuration that loads is
+// saved to the configuration cache in the options, and the cached one is used when the location can't be
+// read or what it has doesn't load.  The server is asked whether a cached url changed before downloading it.
+func LoadConfiguration(options *Options, auth slickClient.Authorizer) (AgentConfiguration, ParsedConfigurationOptions, error) {
+	config, parsed := DefaultConfiguration()
+	cached := readConfigurationCache(options)
+	loaded, err := readConfiguration(options, auth, cached)
+	if err == nil {
+		config, err = decodeConfiguration(options, loaded.Content)
+	}
+	if err != nil && cached != nil && loaded != cached {
+		options.logger().Warn().Msgf("Unable to load configuration from %s, using revision %s cached at %s: %s",
+			options.ConfigurationLocation, cached.revision(), cached.Saved.Format(time.RFC3339), err)
+		loaded = cached
+		config, err = decodeConfiguration(options, loaded.Content)
+		parsed.Revision.FromCache = true
+	} else if err == nil && loaded != cached {
+		writeConfigurationCache(options, loaded)
+	}
+	if loaded != nil {
+		parsed.Revision.Revision = loaded.revision()
+		parsed.Revision.Loaded = time.Now()
+	}
+
+	if err == nil {
+		if config.Slick.AgentName == "" {
+			config.Slick.AgentName = os.Getenv("SLICK_AGENT_NAME")
+			if config.Slick.AgentName == "" {
+				config.Slick.AgentName, _ = os.Hostname()
+			}
+		}
+		d, err := time.ParseDuration(config.CheckForConfigurationEvery)
+		if err == nil {
+			parsed.CheckForConfigurationEvery = d
+		} else {
+			options.logger().Warn().Msgf("Using default of 5 seconds, Error in check-for-configuration-every %#v: %s", config.CheckForConfigurationEvery, err.Error())
+		}
+
+		d, err = time.ParseDuration(config.Sleep.AfterTest)
+		if err == nil {
+			parsed.Sleep.AfterTest = d
+		} else {
+			options.logger().Warn().Msgf("Using default of 500 milliseconds, Error in sleep.after-test %#v: %s", config.Sleep.AfterTest, err.Error())
+		}
+		d, err = time.ParseDuration(config.Sleep.NoTest)
+		if err == nil {
+			parsed.Sleep.NoTest = d
+		} else {
+			options.logger().Warn().Msgf("Using default of 2 seconds, Error in sleep.no-test %#v: %s", config.Sleep.NoTest, err.Error())
+		}
+		d, err = time.ParseDuration(config.ShutdownGracePeriod)
+		if err == nil {
+			parsed.ShutdownGracePeriod = d
+		} else {
+			options.logger().Warn().Msgf("Using default of 5 minutes, Error in shutdown-grace-period %#v: %s", config.ShutdownGracePeriod, err.Error())
+		}
+		d, err = time.ParseDuration(config.Slick.RequestTimeout)
+		if err == nil {
+			parsed.RequestTimeout = d
+		} else {
+			options.logger().Warn().Msgf("Using default of 30 seconds, Error in slick.request-timeout %#v: %s", config.Slick.RequestTimeout, err.Error())
+		}
+		for phase, timeout := range config.Timeouts {
+			d, err = time.ParseDuration(timeout)
+			if err == nil {
+				parsed.Timeouts[phase] = d
+			} else {
+				options.logger().Warn().Msgf("Not using a timeout for %s phases, Error in timeouts.%s %#v: %s", phase, phase, timeout, err.Error())
+			}
+		}
+		// hide parsing errors since we use defaults
+		err = nil
+	}
+	options.logger().Debug().Msgf("Loaded Configuration:\n%+v\nParsed Configuration: %+v, Error: %+v", config, parsed, err)
+	return config, parsed, err
+}
+
+// decodeConfiguration decodes the content of a configuration on top of the defaults and the options.
+func decodeConfiguration(options *Options, content string) (AgentConfiguration, error) {
+	config, _ := DefaultConfiguration()
+	config.APIKey = options.APIKey
+	config.Slick.GrpcUrl = options.GrpcUrl
+	config.Slick.TLS = options.TLS
+	err := yaml.Unmarshal([]byte(content), &config)
+	if err == nil {
+		err = interpolateConfiguration(&config, options)
+	}
+	return config, err
+}
+
+// readConfiguration returns the configuration from the file or url in the options, empty when there's no
+// configuration location.  When the url didn't change since the cached configuration was downloaded the
+// cached one is returned.
+func readConfiguration(options *Options, auth slickClient.Authorizer, cached *cachedConfiguration) (*cachedConfiguration, error) {
+	if strings.HasPrefix(options.ConfigurationLocation, "http") {
+		options.logger().Debug().Msgf("Determined configuration is a url, fetching %#v", options.ConfigurationLocation)
+		return fetchConfiguration(options, auth, cached)
+	} else if options.ConfigurationLocation != "" {
+		content, err := ioutil.ReadFile(options.ConfigurationLocation)
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil && cached.Content == string(content) {
+			return cached, nil
+		}
+		return &cachedConfiguration{Location: options.ConfigurationLocation, Content: string(content)}, nil
+	}
+	return &cachedConfiguration{}, nil
+}
+
+// fetchConfiguration downloads the configuration from the url in the options, logging in again once if the
+// server says the token isn't valid.  The ETag and Last-Modified of the cached configuration are sent, so the
+// server can answer that it didn't change instead of sending it again.  The slick token is only sent to the
+// host slick is on, see sendsConfigurationAuth.
+func fetchConfiguration(options *Options, auth slickClient.Authorizer, cached *cachedConfiguration) (*cachedConfiguration, error) {
+	client := &http.Client{Timeout: slickClient.DefaultRequestTimeout}
+	if auth != nil && !sendsConfigurationAuth(options) {
+		options.logger().Debug().Msgf("Not logging in to fetch %#v, it isn't on slick's host %#v.", options.ConfigurationLocation, options.GrpcUrl)
+		auth = nil
+	}
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest("GET", options.ConfigurationLocation, nil)
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil && cached.ETag != "" {
+			request.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached != nil && cached.LastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+		response, err := slickClient.Do(client, request, auth)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode == 401 && auth != nil && attempt == 0 {
+			options.logger().Debug().Msgf("Configuration server responded with 401, logging in again.")
+			auth.ClearToken()
+			continue
+		}
+		if response.StatusCode == 304 && cached != nil {
+			options.logger().Debug().Msgf("Configuration at %#v didn't change.", options.ConfigurationLocation)
+			return cached, nil
+		}
+		if response.StatusCode != 200 {
+			options.logger().Debug().Msgf("Response had a bad status code of %d.  Full response:\n%+v", response.StatusCode, response)
+			return nil, errors.New(fmt.Sprintf("http status code was %d", response.StatusCode))
+		}
+		options.logger().Debug().Msgf("Reading %d bytes from body of response from %#v", response.ContentLength, options.ConfigurationLocation)
+		content, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil && cached.Content == string(content) {
+			return cached, nil
+		}
+		return &cachedConfiguration{
+			Location:     options.ConfigurationLocation,
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+			Content:      string(content),
+		}, nil
+	}
+}
+
+// sendsConfigurationAuth says whether the configuration url gets the slick token: when it's on the same host as
+// the grpc url the token is for, or ConfigurationAuth says to send it anyway.
+func sendsConfigurationAuth(options *Options) bool {
+	if options.ConfigurationAuth {
+		return true
+	}
+	location, err := url.Parse(options.ConfigurationLocation)
+	if err != nil || location.Hostname() == "" {
+		return false
+	}
+	// the grpc url is a host and port, but may have been given as a url
+	grpcHost := options.GrpcUrl
+	if strings.Contains(grpcHost, "://") {
+		if grpcUrl, err := url.Parse(grpcHost); err == nil {
+			grpcHost = grpcUrl.Host
+		}
+	}
+	if host, _, err := net.SplitHostPort(grpcHost); err == nil {
+		grpcHost = host
+	}
+	return strings.EqualFold(location.Hostname(), strings.Trim(grpcHost, "[]"))
+}
+
+// diffConfiguration describes what changed between two configurations, one line per value that was added,
+// removed or changed, named by its path in the yaml.
+func diffConfiguration(old AgentConfiguration, new AgentConfiguration) []string {
+	oldValues, newValues := make(map[string]string), make(map[string]string)
+	for _, values := range []struct {
+		config AgentConfiguration
+		into   map[string]string
+	}{{old, oldValues}, {new, newValues}} {
+		// going through yaml names the values the way the configuration file does
+		content, err := yaml.Marshal(values.config)
+		var document interface{}
+		if err == nil {
+			err = yaml.Unmarshal(content, &document)
+		}
+		if err != nil {
+			return []string{fmt.Sprintf("unable to compare configurations: %s", err)}
+		}
+		flattenYaml("", document, values.into)
+	}
+	paths := make([]string, 0, len(oldValues)+len(newValues))
+	for path := range oldValues {
+		paths = append(paths, path)
+	}
+	for path := range newValues {
+		if _, ok := oldValues[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	var changes []string
+	for _, path := range paths {
+		oldValue, wasSet := oldValues[path]
+		newValue, isSet := newValues[path]
+		switch {
+		case !wasSet:
+			changes = append(changes, fmt.Sprintf("%s added %s", path, newValue))
+		case !isSet:
+			changes = append(changes, fmt.Sprintf("%s removed, was %s", path, oldValue))
+		case oldValue != newValue:
+			changes = append(changes, fmt.Sprintf("%s changed from %s to %s", path, oldValue, newValue))
+		}
+	}
+	return changes
+}
+
+func flattenYaml(path string, value interface{}, into map[string]string) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			flattenYaml(joinPath(path, fmt.Sprint(key)), item, into)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenYaml(fmt.Sprintf("%s[%d]", path, i), item, into)
+		}
+	default:
+		into[path] = fmt.Sprintf("%#v", v)
+	}
+}
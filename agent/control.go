@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ControlConfiguration turns on the local http api for looking at and controlling a running agent.  The
+// address is only read when the agent starts.
+type ControlConfiguration struct {
+	Address string `yaml:"address,omitempty"`
+	Token   string `yaml:"token,omitempty"`
+}
+
+// ControlStatus is what GET /status returns: the status of the agent, and of its executors when there is more
+// than one.
+type ControlStatus struct {
+	AgentStatus
+	Paused        bool          `json:"paused"`
+	ExitRequested bool          `json:"exitRequested"`
+	Executors     []AgentStatus `json:"executors,omitempty"`
+}
+
+type queuedAction struct {
+	Name      string
+	Parameter string
+}
+
+// control is shared by an agent and its executors.  The agent loop publishes its status and configuration to
+// it, and picks up the requests made through the control api, so the http handlers never touch the agent
+// itself.
+type control struct {
+	mutex         sync.Mutex
+	logger        zerolog.Logger
+	secrets       *Secrets
+	statuses      map[int]AgentStatus
+	config        AgentConfiguration
+	paused        bool
+	exitRequested bool
+	actions       []queuedAction
+}
+
+func newControl() *control {
+	return &control{statuses: make(map[int]AgentStatus)}
+}
+
+// publishStatus makes the agent's current status, and the configuration when it is the agent rather than one
+// of its executors, visible to the control api.
+func (agent *Agent) publishStatus() {
+	if agent.control == nil {
+		return
+	}
+	status := agent.Status.Copy()
+	agent.control.mutex.Lock()
+	defer agent.control.mutex.Unlock()
+	agent.control.statuses[agent.Executor] = status
+	if agent.Executor == 0 {
+		agent.control.config = agent.Config
+		agent.publishConnection()
+	}
+}
+
+// takingTests is false once the agent was paused, or asked to exit, through the control api.
+func (c *control) takingTests() bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.paused && !c.exitRequested
+}
+
+func (c *control) shouldExit() bool {
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.exitRequested
+}
+
+// nextAction returns the oldest action requested through the control api, if any.
+func (c *control) nextAction() (queuedAction, bool) {
+	if c == nil {
+		return queuedAction{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.actions) == 0 {
+		return queuedAction{}, false
+	}
+	action := c.actions[0]
+	c.actions = c.actions[1:]
+	return action, true
+}
+
+// StartControlServer serves the control api on the configured address until the returned server is closed.
+//
+//	GET  /status          the current status of the agent, see ControlStatus
+//	GET  /config          the configuration, with the api key, control token and other secrets redacted
+//	POST /actions/{name}  perform an action from the action-map, with an optional ?parameter=
+//	POST /pause           stop taking tests, a running test is finished
+//	POST /resume          start taking tests again
+//	POST /exit            exit once a running test is finished, like a phase setting shouldExit
+//	GET  /metrics         the agent's prometheus metrics, see Metrics
+//
+// When a token is configured every request needs an Authorization: Bearer header with it.
+func (agent *Agent) StartControlServer() (*http.Server, error) {
+	if agent.control == nil {
+		agent.control = newControl()
+	}
+	agent.control.logger = agent.logger
+	agent.control.secrets = agent.Options.Secrets
+	listener, err := net.Listen("tcp", agent.Config.Control.Address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", agent.control.handleStatus)
+	mux.HandleFunc("/config", agent.control.handleConfig)
+	mux.HandleFunc("/actions/", agent.control.handleAction)
+	mux.HandleFunc("/pause", agent.control.handleFlag(func(c *control) { c.paused = true }, "paused"))
+	mux.HandleFunc("/resume", agent.control.handleFlag(func(c *control) { c.paused = false }, "resumed"))
+	mux.HandleFunc("/exit", agent.control.handleFlag(func(c *control) { c.exitRequested = true }, "exiting"))
+	if agent.metrics != nil {
+		mux.Handle("/metrics", agent.metrics.Handler())
+	}
+	server := &http.Server{Handler: requireToken(agent.Config.Control.Token, mux)}
+	agent.logger.Info().Msgf("Control api listening on %s", listener.Addr())
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			agent.logger.Error().Msgf("Control api stopped: %s", err)
+		}
+	}()
+	return server, nil
+}
+
+func requireToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeJson(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong token"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (c *control) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	c.mutex.Lock()
+	response := ControlStatus{
+		AgentStatus:   c.statuses[0],
+		Paused:        c.paused,
+		ExitRequested: c.exitRequested,
+	}
+	executors := make([]int, 0, len(c.statuses))
+	for executor := range c.statuses {
+		if executor != 0 {
+			executors = append(executors, executor)
+		}
+	}
+	sort.Ints(executors)
+	for _, executor := range executors {
+		response.Executors = append(response.Executors, c.statuses[executor])
+	}
+	c.mutex.Unlock()
+	writeJson(w, http.StatusOK, response)
+}
+
+func (c *control) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	c.mutex.Lock()
+	config := c.config
+	c.mutex.Unlock()
+	if config.APIKey != "" {
+		config.APIKey = "REDACTED"
+	}
+	if config.Control.Token != "" {
+		config.Control.Token = "REDACTED"
+	}
+	// the configuration only has yaml names, so it goes through yaml to get the same keys as the file
+	content, err := yaml.Marshal(config)
+	if err == nil {
+		content, err = yamlToJson(content)
+	}
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// secrets from the environment or files can end up anywhere in the configuration
+	w.Write([]byte(c.secrets.Redact(string(content))))
+}
+
+func (c *control) handleAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/actions/")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.config.ActionMap[name]; !ok || name == "" {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "no action named " + name + " in action-map"})
+		return
+	}
+	action := queuedAction{Name: name, Parameter: r.URL.Query().Get("parameter")}
+	c.actions = append(c.actions, action)
+	c.logger.Info().Msgf("Action %#v with parameter %#v requested through the control api.", action.Name, action.Parameter)
+	writeJson(w, http.StatusAccepted, map[string]string{"action": action.Name, "parameter": action.Parameter})
+}
+
+// handleFlag returns a handler that changes the control state, for the endpoints that only flip a flag.
+func (c *control) handleFlag(change func(c *control), description string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		c.mutex.Lock()
+		change(c)
+		c.mutex.Unlock()
+		c.logger.Info().Msgf("Agent %s through the control api.", description)
+		writeJson(w, http.StatusOK, map[string]string{"status": description})
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "use " + method})
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, code int, value interface{}) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		code = http.StatusInternalServerError
+		content = []byte(`{"error":"unable to encode response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(content)
+}
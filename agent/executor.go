@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/slickqa/slick-agent/slickClient"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// agentSnapshot is what the executors and the goroutines running alongside the loop need from the agent that
+// runs discovery.  The configuration is published whenever it's reloaded and the status after every discovery,
+// so they never read the agent's own state while it's changing.  The generation counts the slick clients the
+// agent has had.
+type agentSnapshot struct {
+	Config     AgentConfiguration
+	Cache      ParsedConfigurationOptions
+	Status     AgentStatus
+	Slick      *slickClient.SlickClient
+	generation int
+}
+
+// retiredClient is a slick client the configuration no longer uses, kept open until no executor can be using it.
+type retiredClient struct {
+	client     *slickClient.SlickClient
+	generation int
+}
+
+// RunExecutors runs count executor slots in their own goroutines, each getting and running tests on its own and
+// reporting to slick as the agent name followed by -1 to -count.  The agent itself only reloads the
+// configuration and runs the discovery phases, and the executors start every loop from its latest status.
+// Actions queued in slick for an executor's name are performed by that executor between tests.
+func (agent *Agent) RunExecutors(ctx context.Context, count int) {
+	loopContext, stopLoop := context.WithCancel(ctx)
+	defer stopLoop()
+
+	agent.Discover()
+	agent.publishSnapshot()
+	var executors sync.WaitGroup
+	for i := 1; i <= count; i++ {
+		executor := &Agent{
+			Options:     agent.Options,
+			Plugins:     agent.Plugins,
+			Executor:    i,
+			control:     agent.control,
+			metrics:     agent.metrics,
+			logger:      agent.logger,
+			testContext: agent.testContext,
+		}
+		executors.Add(1)
+		go func() {
+			defer executors.Done()
+			executor.runExecutor(loopContext, agent, stopLoop)
+		}()
+	}
+
+	for !agent.Status.ShouldExit && sleep(loopContext, agent.Cache.Sleep.NoTest) {
+		agent.Discover()
+		agent.publishSnapshot()
+	}
+	if agent.Status.ShouldExit {
+		agent.logger.Info().Msg("Agent requested to exit!")
+		stopLoop()
+	}
+	executors.Wait()
+}
+
+// runExecutor is the loop of a single executor slot, which ends when ctx is cancelled or one of its phases asks
+// the agent to exit.
+func (executor *Agent) runExecutor(ctx context.Context, agent *Agent, stopLoop context.CancelFunc) {
+	for ctx.Err() == nil {
+		agent.copySnapshot(executor)
+		executor.startIteration()
+		executor.HandleExecutorAction()
+		executor.RunSlot(ctx)
+		if executor.Status.ShouldExit {
+			stopLoop()
+			break
+		}
+		executor.HandleSleep(ctx)
+	}
+	executor.reportExit(ctx)
+	agent.releaseSnapshot(executor)
+}
+
+func (agent *Agent) publishSnapshot() {
+	agent.snapshotMutex.Lock()
+	defer agent.snapshotMutex.Unlock()
+	agent.snapshot.Status = agent.Status.Copy()
+}
+
+// publishConfiguration makes the agent's configuration and slick client visible to the executors and the
+// goroutines running alongside the loop, and lets the screenshot loop know they changed.  The client the
+// agent had before is closed once no executor can be using it.
+func (agent *Agent) publishConfiguration() {
+	agent.snapshotMutex.Lock()
+	agent.snapshot.Config = agent.Config
+	agent.snapshot.Cache = agent.Cache
+	if agent.snapshot.Slick != agent.Slick {
+		agent.snapshot.generation++
+		if agent.snapshot.Slick != nil {
+			agent.retired = append(agent.retired, retiredClient{client: agent.snapshot.Slick, generation: agent.snapshot.generation})
+		}
+		agent.snapshot.Slick = agent.Slick
+		agent.closeRetiredClients()
+	}
+	agent.snapshotMutex.Unlock()
+	select {
+	case agent.configChanged <- struct{}{}:
+	default:
+	}
+}
+
+// currentSnapshot returns the configuration and slick client the agent last published.
+func (agent *Agent) currentSnapshot() agentSnapshot {
+	agent.snapshotMutex.Lock()
+	defer agent.snapshotMutex.Unlock()
+	return agent.snapshot
+}
+
+// copySnapshot gives the executor the agent's latest configuration, slick client and status under its own name.
+func (agent *Agent) copySnapshot(executor *Agent) {
+	agent.snapshotMutex.Lock()
+	defer agent.snapshotMutex.Unlock()
+	executor.Config = agent.snapshot.Config
+	executor.Cache = agent.snapshot.Cache
+	executor.Status = agent.snapshot.Status.Copy()
+	executor.Slick = agent.snapshot.Slick
+	executor.Config.Slick.AgentName = fmt.Sprintf("%s-%d", agent.snapshot.Config.Slick.AgentName, executor.Executor)
+	executor.Status.AgentName = executor.Config.Slick.AgentName
+	agent.executorGenerations[executor.Executor] = agent.snapshot.generation
+	agent.closeRetiredClients()
+}
+
+// releaseSnapshot is called when an executor stops, so the clients it used can be closed.
+func (agent *Agent) releaseSnapshot(executor *Agent) {
+	agent.snapshotMutex.Lock()
+	defer agent.snapshotMutex.Unlock()
+	delete(agent.executorGenerations, executor.Executor)
+	agent.closeRetiredClients()
+}
+
+// closeRetiredClients closes the retired clients every executor has moved past, it's called with the snapshot
+// mutex held.
+func (agent *Agent) closeRetiredClients() {
+	oldest := agent.snapshot.generation
+	for _, generation := range agent.executorGenerations {
+		if generation < oldest {
+			oldest = generation
+		}
+	}
+	kept := agent.retired[:0]
+	for _, retired := range agent.retired {
+		if retired.generation <= oldest {
+			retired.client.Close()
+		} else {
+			kept = append(kept, retired)
+		}
+	}
+	agent.retired = kept
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"golang.org/x/net/context"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+)
+
+// NewLogger creates the logger described by the options: text or json, to stderr or to a log file that is
+// rotated once it reaches LogMaxSize megabytes, at debug level when Debug is set.  The secrets in the options
+// are redacted from every line.
+func NewLogger(options Options) zerolog.Logger {
+	var out io.Writer = os.Stderr
+	if options.LogFile != "" {
+		out = &lumberjack.Logger{
+			Filename:   options.LogFile,
+			MaxSize:    options.LogMaxSize,
+			MaxBackups: options.LogMaxBackups,
+		}
+	}
+	if options.Secrets != nil {
+		out = options.Secrets.Writer(out)
+	}
+	if options.LogFormat != "json" {
+		out = zerolog.ConsoleWriter{Out: out, NoColor: true, TimeFormat: "2006/01/02 15:04:05"}
+	}
+	level := zerolog.InfoLevel
+	if options.Debug {
+		level = zerolog.DebugLevel
+	}
+	return zerolog.New(out).Level(level).With().Timestamp().Logger()
+}
+
+// logger returns the logger from the options, or zerolog's global logger when there isn't one.
+func (options *Options) logger() *zerolog.Logger {
+	if options == nil || options.Logger == nil {
+		return &zlog.Logger
+	}
+	return options.Logger
+}
+
+// loggerFrom returns the logger the agent passed to a phase through ctx, which carries the phase, loop and
+// result fields, or the logger from the options when ApplyToStatus was called without one.
+func loggerFrom(ctx context.Context, options *Options) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return options.logger()
+}
+
+// startIteration moves the agent's logger to the next loop iteration.
+func (agent *Agent) startIteration() {
+	agent.iteration++
+	agent.logger = agent.Options.logger().With().
+		Str("agent", agent.Config.Slick.AgentName).
+		Int("loop", agent.iteration).
+		Logger()
+}
+
+// newCorrelationId returns a random id that is logged with every line about one result.
+func newCorrelationId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/slickqa/slick-agent/slickClient"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics are the prometheus metrics of an agent and its executors, served on /metrics by the control api.
+// Every metric is labeled with the agent name, which for executors is the name they report to slick as, and the
+// company.  They have their own registry so several agents can be embedded in one program.
+type Metrics struct {
+	Registry         *prometheus.Registry
+	phaseDuration    *prometheus.HistogramVec
+	phaseErrors      *prometheus.CounterVec
+	loopIterations   *prometheus.CounterVec
+	tests            *prometheus.CounterVec
+	queuePolls       *prometheus.CounterVec
+	configReloads    *prometheus.CounterVec
+	screenshots      *prometheus.CounterVec
+	slickConnections *connectionCollector
+}
+
+func NewMetrics() *Metrics {
+	labels := []string{"agent", "company"}
+	metrics := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "slick_agent_phase_duration_seconds",
+			Help:    "How long phases took, by phase and source.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}, append(labels, "phase", "source")),
+		phaseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slick_agent_phase_errors_total",
+			Help: "Phases that returned an error, by phase and source.",
+		}, append(labels, "phase", "source")),
+		loopIterations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slick_agent_loop_iterations_total",
+			Help: "Times the agent, or an executor, went through the loop.",
+		}, labels),
+		tests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slick_agent_tests_total",
+			Help: "Tests run, by the status they finished with.",
+		}, append(labels, "status")),
+		queuePolls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slick_agent_queue_polls_total",
+			Help: "Requests to slick's queue for a test, by whether they returned a result, nothing or an error.",
+		}, append(labels, "outcome")),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slick_agent_config_reloads_total",
+			Help: "Times the configuration was reloaded, by whether it succeeded or the cached configuration was used.",
+		}, append(labels, "outcome")),
+		screenshots: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slick_agent_screenshot_uploads_total",
+			Help: "Screenshots uploaded to slick, by whether the upload succeeded.",
+		}, append(labels, "outcome")),
+		slickConnections: &connectionCollector{
+			reconnects: prometheus.NewDesc("slick_agent_grpc_reconnects_total",
+				"Times the grpc connection to slick was re-established.", labels, nil),
+		},
+	}
+	metrics.Registry.MustRegister(metrics.phaseDuration, metrics.phaseErrors, metrics.loopIterations, metrics.tests,
+		metrics.queuePolls, metrics.configReloads, metrics.screenshots, metrics.slickConnections)
+	return metrics
+}
+
+// Handler serves the metrics in the prometheus text format.
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})
+}
+
+// connectionCollector reads the reconnects of the agent's slick client when the metrics are scraped, since the
+// client re-connects on its own.
+type connectionCollector struct {
+	reconnects *prometheus.Desc
+	mutex      sync.Mutex
+	slick      *slickClient.SlickClient
+	labels     []string
+}
+
+func (collector *connectionCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.reconnects
+}
+
+func (collector *connectionCollector) Collect(metrics chan<- prometheus.Metric) {
+	collector.mutex.Lock()
+	slick, labels := collector.slick, collector.labels
+	collector.mutex.Unlock()
+	if slick != nil {
+		metrics <- prometheus.MustNewConstMetric(collector.reconnects, prometheus.CounterValue,
+			float64(slick.Connection().Reconnects), labels...)
+	}
+}
+
+// The methods below are what the agent loop records, they do nothing when the agent has no metrics.
+
+func (agent *Agent) labels(values ...string) []string {
+	return append([]string{agent.Config.Slick.AgentName, agent.Config.Company}, values...)
+}
+
+func (agent *Agent) observePhase(name string, phase *PhaseConfiguration, duration time.Duration, err error) {
+	if agent.metrics == nil {
+		return
+	}
+	labels := agent.labels(name, phase.Source())
+	agent.metrics.phaseDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+	if err != nil {
+		agent.metrics.phaseErrors.WithLabelValues(labels...).Inc()
+	}
+}
+
+func (agent *Agent) countLoop() {
+	if agent.metrics != nil {
+		agent.metrics.loopIterations.WithLabelValues(agent.labels()...).Inc()
+	}
+}
+
+func (agent *Agent) countTest(status string) {
+	if agent.metrics != nil {
+		agent.metrics.tests.WithLabelValues(agent.labels(status)...).Inc()
+	}
+}
+
+func (agent *Agent) countQueuePoll(outcome string) {
+	if agent.metrics != nil {
+		agent.metrics.queuePolls.WithLabelValues(agent.labels(outcome)...).Inc()
+	}
+}
+
+// countConfigReload counts a configuration reload, as cached when the configuration cache was used because the
+// configuration couldn't be loaded.
+func (agent *Agent) countConfigReload(err error, revision ConfigurationRevision) {
+	if agent.metrics != nil {
+		result := outcome(err)
+		if err == nil && revision.FromCache {
+			result = "cached"
+		}
+		agent.metrics.configReloads.WithLabelValues(agent.labels(result)...).Inc()
+	}
+}
+
+// countScreenshot is called by the screenshot loop, so it's labeled from the settings the loop was started with
+// rather than the agent's configuration.
+func (agent *Agent) countScreenshot(settings screenshotSettings, err error) {
+	if agent.metrics != nil {
+		agent.metrics.screenshots.WithLabelValues(settings.agentName, settings.company, outcome(err)).Inc()
+	}
+}
+
+// publishConnection points the reconnects metric at the agent's current slick client.
+func (agent *Agent) publishConnection() {
+	if agent.metrics == nil {
+		return
+	}
+	collector := agent.metrics.slickConnections
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.slick = agent.Slick
+	collector.labels = agent.labels()
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog"
+)
+
+// DefaultMaxCommandOutput is how many bytes of a command's output are kept when max-command-output isn't configured.
+const DefaultMaxCommandOutput = 1024 * 1024
+
+// CommandOutput collects the output of a phase command.  Every line is logged with the phase name, and the last
+// maxSize bytes are kept so they can be attached to the result.
+type CommandOutput struct {
+	logger    zerolog.Logger
+	maxSize   int
+	buffer    []byte
+	partial   []byte
+	truncated bool
+}
+
+func NewCommandOutput(logger zerolog.Logger, phase string, maxSize int) *CommandOutput {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxCommandOutput
+	}
+	return &CommandOutput{
+		logger:  logger.With().Str("phase", phase).Logger(),
+		maxSize: maxSize,
+	}
+}
+
+func (output *CommandOutput) Write(p []byte) (int, error) {
+	output.buffer = append(output.buffer, p...)
+	if len(output.buffer) > output.maxSize {
+		output.buffer = output.buffer[len(output.buffer)-output.maxSize:]
+		output.truncated = true
+	}
+
+	output.partial = append(output.partial, p...)
+	for {
+		i := bytes.IndexByte(output.partial, '\n')
+		if i < 0 {
+			break
+		}
+		output.logger.Info().Msg(string(bytes.TrimRight(output.partial[:i], "\r")))
+		output.partial = output.partial[i+1:]
+	}
+	// don't let a command that never prints a newline grow the line without bound
+	if len(output.partial) > output.maxSize {
+		output.Flush()
+	}
+	return len(p), nil
+}
+
+// Flush logs any output that didn't end with a newline.
+func (output *CommandOutput) Flush() {
+	if len(output.partial) > 0 {
+		output.logger.Info().Msg(string(output.partial))
+		output.partial = nil
+	}
+}
+
+func (output *CommandOutput) Len() int {
+	return len(output.buffer)
+}
+
+// Bytes returns the kept output, noting at the top when the beginning had to be dropped.
+func (output *CommandOutput) Bytes() []byte {
+	if output.truncated {
+		return append([]byte(fmt.Sprintf("[output truncated to the last %d bytes]\n", output.maxSize)), output.buffer...)
+	}
+	return output.buffer
+}
@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/slickqa/slick-agent/slickClient"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type PhaseConfiguration struct {
+	HttpUrl     string            `yaml:"http-url,omitempty"`
+	Command     string            `yaml:"command,omitempty"`
+	WriteFile   string            `yaml:"write-file,omitempty"`
+	ReadFile    string            `yaml:"read-file,omitempty"`
+	StaticList  []string          `yaml:"static-list,omitempty,flow"`
+	StaticMap   map[string]string `yaml:"static-map,omitempty"`
+	StaticValue string            `yaml:"static-value,omitempty"`
+	Plugin      string            `yaml:"plugin,omitempty"`
+	Timeout     string            `yaml:"timeout,omitempty"`
+	When        string            `yaml:"when,omitempty"`
+}
+
+// Source returns the name of the source the phase gets its value from, the one ApplyToStatus uses when more
+// than one is set.
+func (conf *PhaseConfiguration) Source() string {
+	switch {
+	case conf.Plugin != "":
+		return "plugin"
+	case conf.Command != "":
+		return "command"
+	case conf.WriteFile != "":
+		return "write-file"
+	case conf.HttpUrl != "":
+		return "http-url"
+	case conf.ReadFile != "":
+		return "read-file"
+	case conf.StaticValue != "":
+		return "static-value"
+	case len(conf.StaticList) > 0:
+		return "static-list"
+	case len(conf.StaticMap) > 0:
+		return "static-map"
+	}
+	return "none"
+}
+
+// ApplyToStatus runs the phase's source against the status.  A timeout greater than zero limits how long a
+// command may run, after which it and any processes it started are killed, as they are when ctx is cancelled.
+// It limits posting to an http-url too, which otherwise gets the default slick request timeout.
+// The stdout and stderr of a command are written to output when it isn't nil.  Plugin phases need a running
+// helper process, so they are applied by the agent's Plugins instead.
+func (conf *PhaseConfiguration) ApplyToStatus(ctx context.Context, options *Options, status *AgentStatus, timeout time.Duration, output io.Writer, staticVar *string, staticArray *[]string, staticMap *map[string]string) error {
+	logger := loggerFrom(ctx, options)
+	if conf.Command != "" {
+		tmpfile, err := ioutil.TempFile("", "slick-agent-status-*.yml")
+		tmpFilename := tmpfile.Name()
+		if err != nil {
+			logger.Error().Msgf("Unable to write temp file with status before running command %s: %s", conf.Command, err.Error())
+			return err
+		}
+		defer os.Remove(tmpFilename)
+
+		logger.Debug().Msgf("Writing agent status to %s", tmpFilename)
+		content, err := json.Marshal(status)
+		if err != nil {
+			logger.Error().Msgf("Unable to marshal status to json before running command %s: %s", conf.Command, err.Error())
+			return err
+		}
+		_, err = tmpfile.Write(content)
+		if err != nil {
+			logger.Error().Msgf("Error writing temp file %s before running %s: %s", tmpFilename, conf.Command, err.Error())
+			return err
+		}
+		tmpfile.Close()
+
+		logger.Debug().Msgf("Running Command: %s %s %#v", options.ShellCommand, options.ShellOpt, conf.Command)
+		cmd := exec.Command(options.ShellCommand, options.ShellOpt, conf.Command)
+		cmd.Env = append(options.Secrets.Environ(), fmt.Sprintf("SLICK_AGENT_STATUS=%s", tmpFilename))
+		commandErr := runCommand(ctx, cmd, timeout, output)
+		if commandErr == ErrCommandTimeout {
+			status.PhaseTimeout = fmt.Sprintf("command %#v did not finish within %s", conf.Command, timeout)
+			logger.Warn().Msgf("Command %#v timed out after %s and was killed", conf.Command, timeout)
+			return commandErr
+		} else if commandErr == ErrCommandKilled {
+			logger.Error().Msgf("Command %#v encountered an error: %s", conf.Command, commandErr.Error())
+			return commandErr
+		} else if commandErr != nil {
+			// test runners write their status and then exit non-zero when the test failed, so what the command
+			// wrote is still applied before the error is returned
+			logger.Error().Msgf("Command %#v encountered an error: %s", conf.Command, commandErr.Error())
+		}
+		logger.Debug().Msgf("Reading status back in from %s", tmpFilename)
+		content, err = ioutil.ReadFile(tmpFilename)
+		if err != nil {
+			logger.Error().Msgf("Unable to read state from %s after running command %#v: %s", tmpFilename, conf.Command, err.Error())
+			return err
+		}
+
+		newStatus := *status
+		err = json.Unmarshal(content, &newStatus)
+		if err != nil {
+			logger.Error().Msgf("Problem parsing state from %s after running command %#v: %s", tmpFilename, conf.Command, err.Error())
+			return err
+		}
+		logger.Debug().Msgf("Status after command:\n%+v", newStatus)
+		*status = newStatus
+		return commandErr
+	} else if conf.WriteFile != "" {
+		content, err := json.Marshal(status)
+		if err != nil {
+			logger.Error().Msgf("Error serializing agent status to json before writing to file %s: %s", conf.WriteFile, err.Error())
+			return err
+		}
+		err = ioutil.WriteFile(conf.WriteFile, content, 0644)
+		if err != nil {
+			logger.Error().Msgf("Error writing agent status to %s: %s", conf.WriteFile, err.Error())
+			return err
+		}
+	} else if conf.HttpUrl != "" {
+		content, err := json.Marshal(status)
+		if err != nil {
+			logger.Error().Msgf("Error serializing agent status to json before posting to %s: %s", conf.HttpUrl, err.Error())
+			return err
+		}
+		// without a phase timeout the post is limited like a request to slick, so a server that doesn't answer
+		// can't hang the agent
+		if timeout <= 0 {
+			timeout = slickClient.DefaultRequestTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		request, err := http.NewRequest("POST", conf.HttpUrl, bytes.NewBuffer(content))
+		if err != nil {
+			logger.Error().Msgf("Unable to create request to %s: %s", conf.HttpUrl, err.Error())
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		logger.Debug().Msgf("Posting agent status to %s", conf.HttpUrl)
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Do(request.WithContext(ctx))
+		var body []byte
+		if err == nil {
+			defer resp.Body.Close()
+			body, err = ioutil.ReadAll(resp.Body)
+		}
+		if netErr, ok := err.(net.Error); err != nil && (ok && netErr.Timeout() || ctx.Err() == context.DeadlineExceeded) {
+			status.PhaseTimeout = fmt.Sprintf("posting to %s did not finish within %s", conf.HttpUrl, timeout)
+			logger.Warn().Msgf("Posting agent status to %s timed out after %s", conf.HttpUrl, timeout)
+			return err
+		} else if err != nil {
+			logger.Error().Msgf("Error posting agent status to %s: %s", conf.HttpUrl, err.Error())
+			return err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logger.Debug().Msgf("Response had a bad status code of %d.  Body:\n%s", resp.StatusCode, string(body))
+			logger.Error().Msgf("Posting agent status to %s returned http status code %d", conf.HttpUrl, resp.StatusCode)
+			return fmt.Errorf("http status code was %d", resp.StatusCode)
+		}
+		err = applyContentToStatus(body, status, staticVar, staticArray, staticMap)
+		if err != nil {
+			logger.Error().Msgf("Problem applying response from %s to agent status: %s", conf.HttpUrl, err.Error())
+			return err
+		}
+		logger.Debug().Msgf("Status after posting to %s:\n%+v", conf.HttpUrl, *status)
+	} else if conf.ReadFile != "" {
+		logger.Debug().Msgf("Reading status from %s", conf.ReadFile)
+		content, err := ioutil.ReadFile(conf.ReadFile)
+		if err != nil {
+			logger.Error().Msgf("Unable to read %s: %s", conf.ReadFile, err.Error())
+			return err
+		}
+		if !json.Valid(content) {
+			content, err = yamlToJson(content)
+			if err != nil {
+				logger.Error().Msgf("Problem parsing %s as json or yaml: %s", conf.ReadFile, err.Error())
+				return err
+			}
+		}
+		err = applyContentToStatus(content, status, staticVar, staticArray, staticMap)
+		if err != nil {
+			logger.Error().Msgf("Problem applying content of %s to agent status: %s", conf.ReadFile, err.Error())
+			return err
+		}
+		logger.Debug().Msgf("Status after reading %s:\n%+v", conf.ReadFile, *status)
+	} else if conf.StaticValue != "" {
+		if staticVar != nil {
+			*staticVar = conf.StaticValue
+		} else if staticArray != nil {
+			*staticArray = append(*staticArray, conf.StaticValue)
+		} else {
+			logger.Warn().Msgf("Attempted to set static value %#v but that is invalid during this phase, ignoring.", conf.StaticValue)
+			return fmt.Errorf("nil staticVar and staticArray during this phase, cannot set %#v", conf.StaticValue)
+		}
+	} else if len(conf.StaticList) > 0 {
+		if staticArray != nil {
+			*staticArray = append(*staticArray, conf.StaticList...)
+		} else {
+			logger.Warn().Msgf("Attempted to set static list %+v but that is invalid during this phase, ignoring.", conf.StaticList)
+			return fmt.Errorf("nil staticArray, can't set value %#v during this phase", conf.StaticList)
+		}
+	} else if len(conf.StaticMap) > 0 && staticMap != nil {
+		for k, v := range conf.StaticMap {
+			(*staticMap)[k] = v
+		}
+	}
+
+	return nil
+}
+
+// applyContentToStatus applies a json document returned by a phase source to the status.  A document
+// with any of the agent status keys is merged into the status, otherwise a bare string, list or object is
+// routed to the phase's staticVar, staticArray or staticMap target.  Objects like {"hardware": "pixel"} share
+// keys with the status, so when the phase has a staticMap target only an object that can't be a static map,
+// with nothing but status keys and a value that isn't a string, is merged.  Empty content leaves the status
+// alone.
+func applyContentToStatus(content []byte, status *AgentStatus, staticVar *string, staticArray *[]string, staticMap *map[string]string) error {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil
+	}
+	var document interface{}
+	err := json.Unmarshal(content, &document)
+	if err != nil {
+		return err
+	}
+	switch value := document.(type) {
+	case string:
+		if staticVar != nil {
+			*staticVar = value
+		} else if staticArray != nil {
+			*staticArray = append(*staticArray, value)
+		} else {
+			return fmt.Errorf("nil staticVar and staticArray during this phase, cannot set %#v", value)
+		}
+	case []interface{}:
+		if staticArray == nil {
+			return fmt.Errorf("nil staticArray, can't set value %#v during this phase", value)
+		}
+		for _, item := range value {
+			*staticArray = append(*staticArray, fmt.Sprint(item))
+		}
+	case map[string]interface{}:
+		statusKeys := countStatusKeys(value)
+		statusDocument := statusKeys > 0
+		if staticMap != nil {
+			statusDocument = statusKeys == len(value) && !allStrings(value)
+		}
+		if statusDocument {
+			newStatus := *status
+			err = json.Unmarshal(content, &newStatus)
+			if err != nil {
+				return err
+			}
+			*status = newStatus
+		} else if staticMap != nil {
+			for k, v := range value {
+				(*staticMap)[k] = fmt.Sprint(v)
+			}
+		} else {
+			return fmt.Errorf("nil staticMap, can't set value %#v during this phase", value)
+		}
+	case nil:
+		return nil
+	default:
+		return fmt.Errorf("unable to apply %#v to the agent status", value)
+	}
+	return nil
+}
+
+// yamlToJson converts a yaml document to json, so it can be applied to the status like any other content.
+func yamlToJson(content []byte) ([]byte, error) {
+	var document interface{}
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonCompatible(document))
+}
+
+// jsonCompatible replaces the map[interface{}]interface{} values yaml produces with maps json can encode.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+	}
+	return value
+}
+
+// countStatusKeys counts the keys of a json object that AgentStatus is serialized with.
+func countStatusKeys(document map[string]interface{}) int {
+	count := 0
+	statusType := reflect.TypeOf(AgentStatus{})
+	for i := 0; i < statusType.NumField(); i++ {
+		name := strings.Split(statusType.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = statusType.Field(i).Name
+		}
+		if _, ok := document[name]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// allStrings checks whether every value of a json object is a string, as they are in a static map.
+func allStrings(document map[string]interface{}) bool {
+	for _, value := range document {
+		if _, ok := value.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyContentToStatus(t *testing.T) {
+	full, err := json.Marshal(AgentStatus{Hardware: "pixel", Provides: []string{"android"}, RunStatus: "IDLE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		content  string
+		targets  string
+		err      bool
+		hardware string
+		provides []string
+		value    string
+		list     []string
+		static   map[string]string
+	}{
+		{name: "empty", content: "", targets: "value,list,map"},
+		{name: "blank", content: " \n", targets: "value,list,map"},
+		{name: "null", content: "null", targets: "value,list,map"},
+
+		{name: "string to value", content: `"reboot"`, targets: "value,list", value: "reboot"},
+		{name: "string to list", content: `"android"`, targets: "list", list: []string{"android"}},
+		{name: "string to map", content: `"android"`, targets: "map", err: true},
+		{name: "string without a target", content: `"android"`, err: true},
+
+		{name: "list to list", content: `["android", 3]`, targets: "value,list", list: []string{"android", "3"}},
+		{name: "list to value", content: `["android"]`, targets: "value", err: true},
+		{name: "list to map", content: `["android"]`, targets: "map", err: true},
+
+		{name: "object to map", content: `{"os": "android", "api": 29}`, targets: "map", static: map[string]string{"os": "android", "api": "29"}},
+		{name: "object without a target", content: `{"os": "android"}`, targets: "value,list", err: true},
+
+		// objects that share keys with the status go to a static map, and are merged into the status otherwise
+		{name: "test attributes", content: `{"hardware": "pixel", "os": "android"}`, targets: "map", static: map[string]string{"hardware": "pixel", "os": "android"}},
+		{name: "hardware to map", content: `{"hardware": "pixel"}`, targets: "map", static: map[string]string{"hardware": "pixel"}},
+		{name: "hardware to status", content: `{"hardware": "pixel"}`, targets: "value,list", hardware: "pixel"},
+		{name: "hardware without a target", content: `{"hardware": "pixel"}`, hardware: "pixel"},
+		{name: "status keys to map", content: `{"hardware": "pixel", "provides": ["android"]}`, targets: "map", hardware: "pixel", provides: []string{"android"}},
+		{name: "full status to map", content: string(full), targets: "map", hardware: "pixel", provides: []string{"android"}},
+		{name: "full status to list", content: string(full), targets: "list", hardware: "pixel", provides: []string{"android"}},
+
+		{name: "number", content: `3`, targets: "value,list,map", err: true},
+		{name: "invalid json", content: `{"hardware"`, targets: "value,list,map", err: true},
+	}
+	for _, test := range tests {
+		status := AgentStatus{}
+		var value string
+		var list []string
+		static := make(map[string]string)
+		var valueTarget *string
+		var listTarget *[]string
+		var mapTarget *map[string]string
+		for _, target := range strings.Split(test.targets, ",") {
+			switch target {
+			case "value":
+				valueTarget = &value
+			case "list":
+				listTarget = &list
+			case "map":
+				mapTarget = &static
+			}
+		}
+		err := applyContentToStatus([]byte(test.content), &status, valueTarget, listTarget, mapTarget)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected an error %t, got %v", test.name, test.err, err)
+			continue
+		}
+		if status.Hardware != test.hardware || !reflect.DeepEqual(status.Provides, test.provides) {
+			t.Errorf("%s: expected hardware %#v and provides %#v in the status, got %#v and %#v", test.name, test.hardware, test.provides, status.Hardware, status.Provides)
+		}
+		if value != test.value {
+			t.Errorf("%s: expected the value %#v, got %#v", test.name, test.value, value)
+		}
+		if !reflect.DeepEqual(list, test.list) {
+			t.Errorf("%s: expected the list %#v, got %#v", test.name, test.list, list)
+		}
+		if len(static) > 0 || len(test.static) > 0 {
+			if !reflect.DeepEqual(static, test.static) {
+				t.Errorf("%s: expected the map %#v, got %#v", test.name, test.static, static)
+			}
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/context"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Plugins keeps the helper processes started for plugin phases running between loops, so a phase doesn't
+// fork a new shell every time it's applied.  A plugin is started with the shell like a command, and is sent
+// one json-rpc 2.0 request per line on stdin for every phase it's configured for:
+//
+//	{"jsonrpc": "2.0", "id": 1, "method": "discovery", "params": {"phase": "discovery", "status": {...}}}
+//
+// It answers with one line on stdout, where the result is applied like the content of a read-file phase: an
+// agent status document is merged into the status, a string, list or object goes to the phase's target and
+// null changes nothing.
+//
+//	{"jsonrpc": "2.0", "id": 1, "result": ["android", "camera"]}
+//
+// Anything the plugin writes to stderr goes to the agent log.  A plugin that exits or stops answering is
+// restarted the next time it's needed.
+type Plugins struct {
+	mutex   sync.Mutex
+	running map[string]*Plugin
+}
+
+// Plugin is a running helper process.
+type Plugin struct {
+	Command string
+
+	mutex     sync.Mutex
+	logger    *zerolog.Logger
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan pluginLine
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	nextId    int
+}
+
+type pluginLine struct {
+	content []byte
+	err     error
+}
+
+type pluginRequest struct {
+	JsonRpc string       `json:"jsonrpc"`
+	Id      int          `json:"id"`
+	Method  string       `json:"method"`
+	Params  pluginParams `json:"params"`
+}
+
+type pluginParams struct {
+	Phase  string       `json:"phase"`
+	Status *AgentStatus `json:"status"`
+}
+
+type pluginResponse struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *PluginError    `json:"error"`
+}
+
+// PluginError is an error the plugin returned in its response, as opposed to a problem talking to it.
+type PluginError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *PluginError) Error() string {
+	return fmt.Sprintf("plugin error %d: %s", err.Code, err.Message)
+}
+
+func NewPlugins() *Plugins {
+	return &Plugins{
+		running: make(map[string]*Plugin),
+	}
+}
+
+// Apply calls the plugin started with command for the named phase and applies its result to the status,
+// starting the plugin first if it isn't running.  If the plugin can't be talked to it is restarted and the call
+// is tried once more.
+func (plugins *Plugins) Apply(ctx context.Context, options *Options, phase string, command string, status *AgentStatus, timeout time.Duration, staticVar *string, staticArray *[]string, staticMap *map[string]string) error {
+	logger := loggerFrom(ctx, options)
+	result, err := plugins.call(ctx, options, phase, command, status, timeout)
+	if err != nil && err != ErrCommandTimeout && err != ErrCommandKilled {
+		if _, ok := err.(*PluginError); !ok {
+			logger.Warn().Msgf("Problem talking to plugin %#v, restarting it: %s", command, err.Error())
+			plugins.stop(command)
+			result, err = plugins.call(ctx, options, phase, command, status, timeout)
+		}
+	}
+	if err != nil {
+		logger.Error().Msgf("Plugin %#v encountered an error during %s phase: %s", command, phase, err.Error())
+		return err
+	}
+	err = applyContentToStatus(result, status, staticVar, staticArray, staticMap)
+	if err != nil {
+		logger.Error().Msgf("Problem applying result of plugin %#v to agent status: %s", command, err.Error())
+		return err
+	}
+	logger.Debug().Msgf("Status after plugin %#v:\n%+v", command, *status)
+	return nil
+}
+
+func (plugins *Plugins) call(ctx context.Context, options *Options, phase string, command string, status *AgentStatus, timeout time.Duration) (json.RawMessage, error) {
+	plugin, err := plugins.get(options, command)
+	if err != nil {
+		return nil, err
+	}
+	result, err := plugin.Call(ctx, phase, status, timeout)
+	if err == ErrCommandTimeout || err == ErrCommandKilled {
+		// the plugin was killed, so it has to be started again next time
+		plugins.remove(command, plugin)
+	}
+	return result, err
+}
+
+func (plugins *Plugins) get(options *Options, command string) (*Plugin, error) {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+	plugin, ok := plugins.running[command]
+	if ok {
+		return plugin, nil
+	}
+	plugin, err := StartPlugin(options, command)
+	if err != nil {
+		return nil, err
+	}
+	plugins.running[command] = plugin
+	return plugin, nil
+}
+
+func (plugins *Plugins) remove(command string, plugin *Plugin) {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+	if plugins.running[command] == plugin {
+		delete(plugins.running, command)
+	}
+}
+
+func (plugins *Plugins) stop(command string) {
+	plugins.mutex.Lock()
+	plugin, ok := plugins.running[command]
+	delete(plugins.running, command)
+	plugins.mutex.Unlock()
+	if ok {
+		plugin.Stop()
+	}
+}
+
+// StopAll kills every running plugin.
+func (plugins *Plugins) StopAll() {
+	plugins.mutex.Lock()
+	running := plugins.running
+	plugins.running = make(map[string]*Plugin)
+	plugins.mutex.Unlock()
+	for _, plugin := range running {
+		plugin.Stop()
+	}
+}
+
+// StartPlugin starts the helper process for a plugin phase using the shell from the options.
+func StartPlugin(options *Options, command string) (*Plugin, error) {
+	options.logger().Debug().Msgf("Starting plugin: %s %s %#v", options.ShellCommand, options.ShellOpt, command)
+	cmd := exec.Command(options.ShellCommand, options.ShellOpt, command)
+	cmd.Env = options.Secrets.Environ()
+	cmd.Stderr = NewCommandOutput(*options.logger(), "plugin "+command, 0)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	setProcessGroup(cmd)
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	plugin := &Plugin{
+		Command:   command,
+		logger:    options.logger(),
+		cmd:       cmd,
+		stdin:     stdin,
+		responses: make(chan pluginLine),
+		stopped:   make(chan struct{}),
+	}
+	go plugin.readResponses(stdout)
+	return plugin, nil
+}
+
+// readResponses passes every line the plugin writes to stdout on to Call, until stdout is closed.
+func (plugin *Plugin) readResponses(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 || err != nil {
+			select {
+			case plugin.responses <- pluginLine{content: line, err: err}:
+			case <-plugin.stopped:
+				return
+			}
+		}
+		if err != nil {
+			close(plugin.responses)
+			return
+		}
+	}
+}
+
+// Call sends the request for the phase to the plugin and waits for its result.  If the plugin doesn't answer
+// within the timeout, or ctx is cancelled, it is killed.
+func (plugin *Plugin) Call(ctx context.Context, phase string, status *AgentStatus, timeout time.Duration) (json.RawMessage, error) {
+	plugin.mutex.Lock()
+	defer plugin.mutex.Unlock()
+
+	plugin.nextId++
+	request, err := json.Marshal(pluginRequest{
+		JsonRpc: "2.0",
+		Id:      plugin.nextId,
+		Method:  phase,
+		Params:  pluginParams{Phase: phase, Status: status},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = plugin.stdin.Write(append(request, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case line, ok := <-plugin.responses:
+		if !ok {
+			return nil, errors.New("plugin exited")
+		}
+		if line.err != nil {
+			return nil, fmt.Errorf("reading response from plugin: %s", line.err.Error())
+		}
+		var response pluginResponse
+		err = json.Unmarshal(line.content, &response)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response %#v from plugin: %s", string(line.content), err.Error())
+		}
+		if response.Id != plugin.nextId {
+			return nil, fmt.Errorf("plugin answered request %d, expected %d", response.Id, plugin.nextId)
+		}
+		if response.Error != nil {
+			return nil, response.Error
+		}
+		return response.Result, nil
+	case <-expired:
+		plugin.kill()
+		return nil, ErrCommandTimeout
+	case <-ctx.Done():
+		plugin.kill()
+		return nil, ErrCommandKilled
+	}
+}
+
+// Stop closes the plugin's stdin, which should make it exit, and kills it if it's still running a second later.
+func (plugin *Plugin) Stop() {
+	plugin.stopOnce.Do(func() { close(plugin.stopped) })
+	plugin.stdin.Close()
+	done := make(chan struct{})
+	go func() {
+		plugin.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		if err := killProcessGroup(plugin.cmd); err != nil {
+			plugin.logger.Error().Msg(err.Error())
+		}
+		<-done
+	}
+}
+
+func (plugin *Plugin) kill() {
+	plugin.stopOnce.Do(func() { close(plugin.stopped) })
+	if err := killProcessGroup(plugin.cmd); err != nil {
+		plugin.logger.Error().Msg(err.Error())
+	}
+	plugin.cmd.Wait()
+}
@@ -0,0 +1,17 @@
+package agent
+
+import (
+	"github.com/slickqa/slick-agent/slickClient"
+)
+
+// Result is a result from slick's queue that the agent was given to run, see slickClient.Result.
+type Result = slickClient.Result
+
+type ResultReference = slickClient.ResultReference
+
+type TestcaseInfo = slickClient.TestcaseInfo
+
+// ParseResult builds a result from the json object slick returned, see slickClient.ParseResult.
+func ParseResult(raw map[string]interface{}) (*Result, error) {
+	return slickClient.ParseResult(raw)
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestResultInStatusFile goes through the status file a command phase sees, where the command can change the
+// result, and what it doesn't know about has to come back unchanged.
+func TestResultInStatusFile(t *testing.T) {
+	var raw map[string]interface{}
+	json.Unmarshal([]byte(`{"id": "r1", "testcase": {"testcaseId": "t1", "name": "login"}, "testrun": null, "config": {"browser": "firefox"}, "files": []}`), &raw)
+	result, err := ParseResult(raw)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	content, err := json.Marshal(AgentStatus{ResultToRun: result})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// a command marks the test as failed
+	var file map[string]interface{}
+	json.Unmarshal(content, &file)
+	file["testcase"].(map[string]interface{})["status"] = "FAIL"
+	content, _ = json.Marshal(file)
+
+	status := AgentStatus{ResultToRun: result}
+	if err = json.Unmarshal(content, &status); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if status.ResultToRun.Id != "r1" || status.ResultToRun.Status != "FAIL" || status.ResultToRun.Testcase.Name != "login" {
+		t.Errorf("the result read back is %+v", status.ResultToRun)
+	}
+	for _, key := range []string{"config", "files", "testrun"} {
+		if !reflect.DeepEqual(status.ResultToRun.Raw[key], raw[key]) {
+			t.Errorf("%s was %#v, read back as %#v", key, raw[key], status.ResultToRun.Raw[key])
+		}
+	}
+
+	// a command clears the result
+	status = AgentStatus{ResultToRun: result}
+	if err = json.Unmarshal([]byte(`{"testcase": null}`), &status); err != nil || status.ResultToRun != nil {
+		t.Errorf("expected the result to be cleared, got %+v, %v", status.ResultToRun, err)
+	}
+}
@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretsConfiguration names the configuration values and environment variables that hold secrets, on top of
+// the ones the agent knows about, and the environment variables commands are still given.
+type SecretsConfiguration struct {
+	Fields         []string `yaml:"fields,omitempty"`
+	Env            []string `yaml:"env,omitempty"`
+	PassToCommands []string `yaml:"pass-to-commands,omitempty"`
+}
+
+// defaultSecretEnv are environment variables the agent reads secrets from itself.
+var defaultSecretEnv = []string{"SLICK_AGENT_API_KEY"}
+
+// secretFields are the configuration values that are always secrets, by their path in the configuration.
+var secretFields = map[string]bool{
+	"api-key":       true,
+	"control.token": true,
+}
+
+// configurationReference matches the ${env:NAME} and ${file:/path} references interpolateConfiguration replaces,
+// and the same with $$ in front, which are written without the first $.
+var configurationReference = regexp.MustCompile(`\$?\$\{(env|file):([^}]*)\}`)
+
+// Secrets are the values that are never logged or shown by the control api, and the environment variables
+// holding secrets that commands don't get.  They are shared by everything created from the same options, and
+// only grow as the configuration is reloaded, so an old api key stays redacted too.
+type Secrets struct {
+	mutex   sync.RWMutex
+	values  map[string]bool
+	env     map[string]bool
+	allowed map[string]bool
+}
+
+func NewSecrets() *Secrets {
+	secrets := &Secrets{values: make(map[string]bool), env: make(map[string]bool), allowed: make(map[string]bool)}
+	secrets.setEnv(nil, nil)
+	return secrets
+}
+
+// Add makes the values secrets.
+func (secrets *Secrets) Add(values ...string) {
+	if secrets == nil {
+		return
+	}
+	secrets.mutex.Lock()
+	defer secrets.mutex.Unlock()
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		secrets.values[value] = true
+		// json logs and the control api escape the value, so that's what has to be found in them
+		if escaped, err := json.Marshal(value); err == nil {
+			secrets.values[string(escaped[1:len(escaped)-1])] = true
+		}
+	}
+}
+
+// setEnv replaces the environment variables holding secrets with the defaults and env, making their values
+// secrets, and the ones commands are still given with allowed.
+func (secrets *Secrets) setEnv(env []string, allowed []string) {
+	names := append(append([]string{}, defaultSecretEnv...), env...)
+	secrets.mutex.Lock()
+	secrets.env = make(map[string]bool, len(names))
+	for _, name := range names {
+		secrets.env[name] = true
+	}
+	secrets.allowed = make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		secrets.allowed[name] = true
+	}
+	secrets.mutex.Unlock()
+	for _, name := range names {
+		secrets.Add(os.Getenv(name))
+	}
+}
+
+// Redact replaces every secret in text with REDACTED.
+func (secrets *Secrets) Redact(text string) string {
+	if secrets == nil {
+		return text
+	}
+	secrets.mutex.RLock()
+	values := make([]string, 0, len(secrets.values))
+	for value := range secrets.values {
+		if strings.Contains(text, value) {
+			values = append(values, value)
+		}
+	}
+	secrets.mutex.RUnlock()
+	// longer values first, so a secret containing another one is redacted whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		text = strings.Replace(text, value, "REDACTED", -1)
+	}
+	return text
+}
+
+// Environ returns the agent's environment for a command, without the environment variables holding secrets
+// that weren't passed to commands.
+func (secrets *Secrets) Environ() []string {
+	environment := os.Environ()
+	if secrets == nil {
+		return environment
+	}
+	secrets.mutex.RLock()
+	defer secrets.mutex.RUnlock()
+	filtered := make([]string, 0, len(environment))
+	for _, variable := range environment {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if !secrets.env[name] || secrets.allowed[name] {
+			filtered = append(filtered, variable)
+		}
+	}
+	return filtered
+}
+
+// Writer returns a writer that redacts the secrets from what is written to out, for the logger.
+func (secrets *Secrets) Writer(out io.Writer) io.Writer {
+	return redactingWriter{secrets: secrets, out: out}
+}
+
+type redactingWriter struct {
+	secrets *Secrets
+	out     io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	redacted := w.secrets.Redact(string(p))
+	if _, err := io.WriteString(w.out, redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// interpolateConfiguration replaces the ${env:NAME} and ${file:/path} references in every string of the
+// configuration with the environment variable or the content of the file, without its trailing newline.
+// $${env: and $${file: are written as they are, without the first $, and everything else, like the shell's own
+// ${NAME}, is left alone.  References to environment variables that aren't set are left as written too.  The
+// secret fields, the ones listed in secrets.fields, and the files and environment variables they reference
+// become secrets.  A secret environment variable commands don't get can't be put anywhere else, so it doesn't
+// end up on a command line.
+func interpolateConfiguration(config *AgentConfiguration, options *Options) error {
+	var secretEnv []string
+	fields := config.Secrets.Fields
+	protectedEnv := make(map[string]bool)
+	for _, name := range append(append([]string{}, defaultSecretEnv...), config.Secrets.Env...) {
+		protectedEnv[name] = !contains(config.Secrets.PassToCommands, name)
+	}
+	expand := func(path string, value string) (string, error) {
+		secret := secretFields[path] || contains(fields, path)
+		var err error
+		result := configurationReference.ReplaceAllStringFunc(value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+			match := configurationReference.FindStringSubmatch(reference)
+			if match[1] == "file" {
+				content, readErr := ioutil.ReadFile(match[2])
+				if readErr != nil {
+					if err == nil {
+						err = fmt.Errorf("%s: %s", path, readErr)
+					}
+					return reference
+				}
+				replacement := strings.TrimRight(string(content), "\r\n")
+				if secret {
+					options.Secrets.Add(replacement)
+				}
+				return replacement
+			}
+			name := match[2]
+			env, ok := os.LookupEnv(name)
+			if !ok {
+				options.logger().Warn().Msgf("Leaving %s in %s as it is, %s isn't set.", reference, path, name)
+				return reference
+			}
+			if protectedEnv[name] && !secret {
+				options.logger().Warn().Msgf("Leaving %s in %s as it is, %s holds a secret and %s isn't a secret value.", reference, path, name, path)
+				return reference
+			}
+			if secret {
+				secretEnv = append(secretEnv, name)
+			}
+			return env
+		})
+		if err != nil {
+			return "", err
+		}
+		if secret {
+			options.Secrets.Add(result)
+		}
+		return result, nil
+	}
+	if err := interpolateValue(reflect.ValueOf(config).Elem(), "", expand); err != nil {
+		return err
+	}
+	if options.Secrets != nil {
+		options.Secrets.setEnv(append(secretEnv, config.Secrets.Env...), config.Secrets.PassToCommands)
+	}
+	return nil
+}
+
+// interpolateValue calls expand on every string in value, naming them by their path in the yaml.
+func interpolateValue(value reflect.Value, path string, expand func(path string, value string) (string, error)) error {
+	switch value.Kind() {
+	case reflect.String:
+		expanded, err := expand(path, value.String())
+		if err != nil {
+			return err
+		}
+		value.SetString(expanded)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(field.Tag.Get("yaml"), ",")
+			fieldPath := path
+			if !(len(tag) > 1 && tag[1] == "inline") {
+				fieldPath = joinPath(path, tag[0])
+			}
+			if err := interpolateValue(value.Field(i), fieldPath, expand); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := interpolateValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i), expand); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			// map values can't be changed in place, so a copy is interpolated and put back
+			element := reflect.New(value.Type().Elem()).Elem()
+			element.Set(value.MapIndex(key))
+			if err := interpolateValue(element, joinPath(path, key.String()), expand); err != nil {
+				return err
+			}
+			value.SetMapIndex(key, element)
+		}
+	}
+	return nil
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
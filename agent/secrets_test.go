@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slick-agent-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	nameFile := filepath.Join(dir, "name")
+	ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+	ioutil.WriteFile(nameFile, []byte("pixel-agent\r\n"), 0600)
+	os.Setenv("SLICK_AGENT_TEST_KEY", "env-key")
+	os.Setenv("SLICK_AGENT_TEST_HOST", "slick.example.com")
+	os.Setenv("SLICK_AGENT_TEST_PASSWORD", "hunter2")
+	os.Setenv("SLICK_AGENT_TEST_PASSED", "passed-on")
+	os.Unsetenv("SLICK_AGENT_TEST_UNSET")
+	defer func() {
+		for _, name := range []string{"SLICK_AGENT_TEST_KEY", "SLICK_AGENT_TEST_HOST", "SLICK_AGENT_TEST_PASSWORD", "SLICK_AGENT_TEST_PASSED"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	options := DefaultOptions()
+	config, _ := DefaultConfiguration()
+	config.APIKey = "${env:SLICK_AGENT_TEST_KEY}"
+	config.Control.Token = "${file:" + tokenFile + "}"
+	config.Slick.BaseUrl = "https://${env:SLICK_AGENT_TEST_HOST}/slick"
+	config.Slick.AgentName = "${file:" + nameFile + "}"
+	config.Secrets.Env = []string{"SLICK_AGENT_TEST_PASSWORD", "SLICK_AGENT_TEST_PASSED"}
+	config.Secrets.PassToCommands = []string{"SLICK_AGENT_TEST_PASSED"}
+	config.Secrets.Fields = []string{"action-map.deploy.command"}
+	config.LoopStart = []PhaseConfiguration{
+		{Command: "PATH=/opt/bin:$PATH; tool ${PATH}"},
+		{Command: "HOME=/tmp; cd ${HOME} && echo ${name:-default}"},
+		{Command: "echo $${env:SLICK_AGENT_TEST_HOST} $${file:/etc/hosts}"},
+		{Command: "deploy --key ${env:SLICK_AGENT_TEST_PASSWORD}"},
+		{Command: "deploy --key ${env:SLICK_AGENT_TEST_PASSED}"},
+		{Command: "echo ${env:SLICK_AGENT_TEST_UNSET}"},
+	}
+	config.ActionMap = map[string]ActionConfiguration{
+		"deploy": {PhaseConfiguration: PhaseConfiguration{Command: "deploy --key ${env:SLICK_AGENT_TEST_PASSWORD}"}},
+	}
+	if err := interpolateConfiguration(&config, &options); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	values := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"api-key", config.APIKey, "env-key"},
+		{"control.token", config.Control.Token, "file-token"},
+		{"slick.base-url", config.Slick.BaseUrl, "https://slick.example.com/slick"},
+		{"slick.agent-name", config.Slick.AgentName, "pixel-agent"},
+		{"loop-start[0].command", config.LoopStart[0].Command, "PATH=/opt/bin:$PATH; tool ${PATH}"},
+		{"loop-start[1].command", config.LoopStart[1].Command, "HOME=/tmp; cd ${HOME} && echo ${name:-default}"},
+		{"loop-start[2].command", config.LoopStart[2].Command, "echo ${env:SLICK_AGENT_TEST_HOST} ${file:/etc/hosts}"},
+		{"loop-start[3].command", config.LoopStart[3].Command, "deploy --key ${env:SLICK_AGENT_TEST_PASSWORD}"},
+		{"loop-start[4].command", config.LoopStart[4].Command, "deploy --key passed-on"},
+		{"loop-start[5].command", config.LoopStart[5].Command, "echo ${env:SLICK_AGENT_TEST_UNSET}"},
+		{"action-map.deploy.command", config.ActionMap["deploy"].Command, "deploy --key hunter2"},
+	}
+	for _, value := range values {
+		if value.value != value.expected {
+			t.Errorf("%s: expected %#v, got %#v", value.name, value.expected, value.value)
+		}
+	}
+
+	redacted := options.Secrets.Redact("env-key file-token slick.example.com pixel-agent hunter2 passed-on")
+	if expected := "REDACTED REDACTED slick.example.com pixel-agent REDACTED REDACTED"; redacted != expected {
+		t.Errorf("expected %#v to be redacted as %#v", redacted, expected)
+	}
+	environment := strings.Join(options.Secrets.Environ(), "\n")
+	for _, variable := range []string{"SLICK_AGENT_TEST_KEY=", "SLICK_AGENT_TEST_PASSWORD="} {
+		if strings.Contains(environment, variable) {
+			t.Errorf("commands get the secret %s", variable)
+		}
+	}
+	for _, variable := range []string{"SLICK_AGENT_TEST_HOST=", "SLICK_AGENT_TEST_PASSED="} {
+		if !strings.Contains(environment, variable) {
+			t.Errorf("commands don't get %s", variable)
+		}
+	}
+}
+
+func TestInterpolateConfigurationMissingFile(t *testing.T) {
+	options := DefaultOptions()
+	config, _ := DefaultConfiguration()
+	config.Control.Token = "${file:/nonexistent/slick-agent-token}"
+	err := interpolateConfiguration(&config, &options)
+	if err == nil || !strings.HasPrefix(err.Error(), "control.token: ") {
+		t.Errorf("expected an error for control.token, got %v", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	secrets := NewSecrets()
+	secrets.Add("secret", "secret-with-more", `quo"te\slash`, "")
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"the secret is out", "the REDACTED is out"},
+		// the longer secret is redacted whole, not as a redacted secret followed by the rest of it
+		{"secret-with-more and secret", "REDACTED and REDACTED"},
+		{`raw quo"te\slash`, "raw REDACTED"},
+		// json escapes the value, which has to be found too
+		{`{"message":"quo\"te\\slash"}`, `{"message":"REDACTED"}`},
+	}
+	for _, test := range tests {
+		if redacted := secrets.Redact(test.text); redacted != test.expected {
+			t.Errorf("%#v: expected %#v, got %#v", test.text, test.expected, redacted)
+		}
+	}
+
+	var nothing *Secrets
+	if redacted := nothing.Redact("secret"); redacted != "secret" {
+		t.Errorf("nil secrets changed the text to %#v", redacted)
+	}
+
+	var out bytes.Buffer
+	writer := secrets.Writer(&out)
+	line := "logged the secret\n"
+	if n, err := writer.Write([]byte(line)); err != nil || n != len(line) {
+		t.Errorf("write returned %d, %v", n, err)
+	}
+	if out.String() != "logged the REDACTED\n" {
+		t.Errorf("the writer wrote %#v", out.String())
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	os.Setenv("SLICK_AGENT_API_KEY", "default-secret")
+	os.Setenv("SLICK_AGENT_TEST_SECRET", "listed-secret")
+	os.Setenv("SLICK_AGENT_TEST_ALLOWED", "allowed-secret")
+	os.Setenv("SLICK_AGENT_TEST_PLAIN", "plain")
+	defer func() {
+		for _, name := range []string{"SLICK_AGENT_API_KEY", "SLICK_AGENT_TEST_SECRET", "SLICK_AGENT_TEST_ALLOWED", "SLICK_AGENT_TEST_PLAIN"} {
+			os.Unsetenv(name)
+		}
+	}()
+	secrets := NewSecrets()
+	secrets.setEnv([]string{"SLICK_AGENT_TEST_SECRET", "SLICK_AGENT_TEST_ALLOWED"}, []string{"SLICK_AGENT_TEST_ALLOWED"})
+	environment := make(map[string]bool)
+	for _, variable := range secrets.Environ() {
+		environment[variable] = true
+	}
+	expected := map[string]bool{
+		"SLICK_AGENT_API_KEY=default-secret":      false,
+		"SLICK_AGENT_TEST_SECRET=listed-secret":   false,
+		"SLICK_AGENT_TEST_ALLOWED=allowed-secret": true,
+		"SLICK_AGENT_TEST_PLAIN=plain":            true,
+	}
+	for variable, passed := range expected {
+		if environment[variable] != passed {
+			t.Errorf("%s: expected it to be passed to commands %t, got %t", variable, passed, environment[variable])
+		}
+	}
+	// the values are secrets even when commands get them
+	if redacted := secrets.Redact("default-secret listed-secret allowed-secret plain"); redacted != "REDACTED REDACTED REDACTED plain" {
+		t.Errorf("redacted as %#v", redacted)
+	}
+}
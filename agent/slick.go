@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/slickqa/screenshot"
+	"github.com/slickqa/slick-agent/slickClient"
+	"github.com/slickqa/slick/slickqa"
+	"golang.org/x/net/context"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ReportTestResult finishes the current result in slick.  The agent's own UNKNOWN and TIMED_OUT statuses are
+// reported as BROKEN_TEST, since slick doesn't know about them.
+func (agent *Agent) ReportTestResult(status string, reason string, runLength time.Duration) {
+	if status == "UNKNOWN" || status == "TIMED_OUT" {
+		status = "BROKEN_TEST"
+	}
+	agent.Status.ResultToRun.Status = status
+	if reason != "" {
+		agent.Status.ResultToRun.Reason = reason
+	}
+	agent.finishResult(agent.Status.ResultToRun.Id, status, reason, runLength)
+}
+
+// reportingContext is what results are reported to slick with.  It lasts through the shutdown grace period, so a
+// test that finishes during it still gets its result.
+func (agent *Agent) reportingContext() context.Context {
+	if agent.testContext != nil {
+		return agent.testContext
+	}
+	return context.Background()
+}
+
+// finishResult sets the status of the result in slick and marks it as finished.
+func (agent *Agent) finishResult(id string, status string, reason string, runLength time.Duration) {
+	if agent.Config.Slick.BaseUrl == "" {
+		return
+	}
+	update := map[string]interface{}{
+		"status":    status,
+		"runstatus": "FINISHED",
+		"runlength": runLength.Nanoseconds() / int64(time.Millisecond),
+		"finished":  time.Now().UnixNano() / int64(time.Millisecond),
+		"hostname":  agent.Config.Slick.AgentName,
+	}
+	if reason != "" {
+		update["reason"] = reason
+	}
+	agent.logger.Debug().Msgf("Reporting result %s to slick: %+v", id, update)
+	err := agent.rest().UpdateResult(agent.reportingContext(), id, update)
+	if err != nil {
+		agent.logger.Error().Msgf("Error reporting result %s to slick: %s", id, err.Error())
+	}
+}
+
+func uploadFile(filename string, url string, contentType string) error {
+	data, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open file %s: %s", filename, err)
+	}
+	defer data.Close()
+	stat, err := data.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat file %s after opening: %s", filename, err)
+	}
+	req, err := http.NewRequest("PUT", url, data)
+	if err != nil {
+		return fmt.Errorf("unable to create request to upload file %s to %s: %s", filename, url, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = stat.Size()
+
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading file %s to %s: %s", filename, url, err)
+	}
+	defer res.Body.Close()
+	return nil
+}
+
+// findOrAddFileLink looks up the link with the given identity in slick, adding it as a file link if it
+// doesn't exist yet.
+func findOrAddFileLink(client *slickClient.SlickClient, id *slickqa.LinkIdentity) (*slickqa.Link, error) {
+	links, err := client.Links.GetLinks(context.Background(), &slickqa.LinkListIdentity{Company: id.Company, Project: id.Project, EntityType: id.EntityType, EntityId: id.EntityId})
+	if err == nil && links != nil {
+		for _, potential := range links.Links {
+			if potential.Id.Name == id.Name {
+				return potential, nil
+			}
+		}
+	}
+	links, err = client.Links.AddLink(context.Background(), &slickqa.Link{Id: id, Type: "File"})
+	if err != nil {
+		return nil, err
+	}
+	for _, potential := range links.Links {
+		if potential.Id.Name == id.Name {
+			return potential, nil
+		}
+	}
+	return nil, fmt.Errorf("link %s was not in the list returned after adding it", id.Name)
+}
+
+// uploadTestOutput attaches the output of the run-test commands to the current result as the "output" link.
+func (agent *Agent) uploadTestOutput(output *CommandOutput) {
+	if agent.Slick == nil || agent.Status.ResultToRun == nil {
+		return
+	}
+	testInfo := agent.Status.ResultToRun.TestcaseInfo()
+	link, err := findOrAddFileLink(agent.Slick, &slickqa.LinkIdentity{
+		Company:    agent.Config.Company,
+		Project:    agent.Status.ResultToRun.Project.Name,
+		EntityType: "Result",
+		EntityId:   testInfo.Id,
+		Name:       "output",
+	})
+	if err != nil {
+		agent.logger.Error().Msgf("Unable to find or create a link for the run-test output of result %s: %s", testInfo.Id, err)
+		return
+	}
+
+	tmpfile, err := ioutil.TempFile("", "slick-agent-output-*.txt")
+	if err != nil {
+		agent.logger.Error().Msgf("Unable to create temp file for the run-test output: %s", err.Error())
+		return
+	}
+	tmpFilename := tmpfile.Name()
+	defer os.Remove(tmpFilename)
+	_, err = tmpfile.Write(output.Bytes())
+	tmpfile.Close()
+	if err != nil {
+		agent.logger.Error().Msgf("Error writing run-test output to %s: %s", tmpFilename, err.Error())
+		return
+	}
+
+	uploadInfo := &slickqa.FileUploadInfo{
+		Id:          link.Id,
+		FileName:    "output.txt",
+		ContentType: "text/plain",
+		Size:        int64(len(output.Bytes())),
+	}
+	uploadUrl, err := agent.Slick.Links.GetUploadUrl(context.Background(), uploadInfo)
+	if err != nil {
+		agent.logger.Error().Msgf("Unable to get URL for uploading run-test output: %s", err)
+		return
+	}
+	err = uploadFile(tmpFilename, uploadUrl.Url, uploadInfo.ContentType)
+	if err != nil {
+		agent.logger.Error().Msgf("Unable to upload run-test output: %s", err)
+	}
+}
+
+// screenshotSettings are what the screenshot loop depends on, it's restarted when they change.
+type screenshotSettings struct {
+	slick     *slickClient.SlickClient
+	company   string
+	agentName string
+}
+
+func (a *Agent) screenshotSettings() screenshotSettings {
+	snapshot := a.currentSnapshot()
+	return screenshotSettings{slick: snapshot.Slick, company: snapshot.Config.Company, agentName: snapshot.Config.Slick.AgentName}
+}
+
+// runScreenShots runs the screenshot loop until ctx is cancelled, restarting it when the configuration
+// reloads with a different slick client, company or agent name.
+func (a *Agent) runScreenShots(ctx context.Context) {
+	for ctx.Err() == nil {
+		settings := a.screenshotSettings()
+		logger := a.Options.logger().With().Str("agent", settings.agentName).Logger()
+		loopContext, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			a.startScreenShots(loopContext, settings, logger)
+			close(done)
+		}()
+		for changed := false; !changed && ctx.Err() == nil; {
+			select {
+			case <-ctx.Done():
+			case <-a.configChanged:
+				changed = a.screenshotSettings() != settings
+			}
+		}
+		stop()
+		<-done
+		if ctx.Err() == nil {
+			logger.Info().Msg("Screenshot settings changed, restarting the screenshot loop")
+		}
+	}
+}
+
+func (a *Agent) startScreenShots(ctx context.Context, settings screenshotSettings, logger zerolog.Logger) {
+	//bounds := screenshot.GetDisplayBounds(0)
+	if settings.slick != nil {
+		screen, err := screenshot.CreateScreenshotUtility()
+		if err != nil {
+			logger.Error().Msgf("Error initializing screenshots! %s", err.Error())
+			if !sleep(ctx, 5*time.Second) {
+				return
+			}
+			screen, err = screenshot.CreateScreenshotUtility()
+			if err != nil {
+				return
+			}
+		}
+		defer screen.Close()
+
+		link, err := findOrAddFileLink(settings.slick, &slickqa.LinkIdentity{
+			Company:    settings.company,
+			Project:    "Agent",
+			EntityType: "Agent",
+			EntityId:   settings.agentName,
+			Name:       "screen",
+		})
+		if err != nil {
+			logger.Error().Msgf("Unable to find or create a link for the screenshot: %s", err)
+			return
+		}
+		logger.Info().Msg("Starting screenshot loop")
+		for ctx.Err() == nil {
+			img, err := screen.CaptureScreen()
+			if err != nil {
+				logger.Error().Msgf("Error grabbing screenshot: %s", err)
+				sleep(ctx, 4*time.Second)
+				continue
+			}
+			fileName := settings.agentName + "-screenshot.png"
+			file, _ := os.Create(fileName)
+			png.Encode(file, img)
+			file.Close()
+			uploadInfo := &slickqa.FileUploadInfo{
+				Id:          link.Id,
+				FileName:    fileName,
+				ContentType: "image/png",
+			}
+			uploadUrl, err := settings.slick.Links.GetUploadUrl(context.Background(), uploadInfo)
+			if err != nil {
+				logger.Error().Msgf("Unable to get URL for uploading screenshot: %s", err)
+				a.countScreenshot(settings, err)
+				sleep(ctx, 4*time.Second)
+				continue
+			}
+			err = uploadFile(fileName, uploadUrl.Url, uploadInfo.ContentType)
+			if err != nil {
+				logger.Error().Msgf("Unable to upload screenshot: %s", err)
+			}
+			a.countScreenshot(settings, err)
+			settings.slick.Agents.UpdateScreenshotTimestamp(context.Background(), &slickqa.ScreenshotUpdateRequest{Id: &slickqa.AgentId{Company: settings.company, Name: settings.agentName}})
+			sleep(ctx, 4*time.Second)
+		}
+	} else {
+		logger.Info().Msg("Slick grpc communication is nil, no screenshots will be taken.")
+	}
+
+}
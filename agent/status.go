@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"github.com/slickqa/slick-agent/slickClient"
+	"github.com/slickqa/slick/slickqa"
+)
+
+type AgentStatus struct {
+	Provides               []string                           `json:"provides"`
+	BrokenProvides         []string                           `json:"broken"`
+	RunStatus              string                             `json:"runStatus"`
+	Projects               []*slickqa.ProjectReleaseBuildInfo //[]ProjectReleaseBuild `json:"projects,omitempty"`
+	Versions               map[string]string                  `json:"versions,omitempty"`
+	Hardware               string                             `json:"hardware,omitempty"`
+	RequiredTestAttributes map[string]string                  `json:"requiredAttrs,omitempty"`
+	RanTest                bool                               `json:"ranTest"`
+	Action                 string                             `json:"action,omitempty"`
+	ActionParameter        string                             `json:"actionParameter,omitempty"`
+	IP                     string                             `json:"IP,omitempty"`
+	Attributes             map[string]string                  `json:"attributes"`
+	ResultToRun            *Result                            `json:"testcase"`
+	Groups                 []string                           `json:"groups"`
+	ShouldExit             bool                               `json:"shouldExit"`
+	AgentName              string                             `json:"agentName"`
+	PhaseTimeout           string                             `json:"phaseTimeout,omitempty"`
+	LastAction             *ActionResult                      `json:"lastAction,omitempty"`
+	SlickQueueErrors       int                                `json:"slickQueueErrors"`
+	SlickConnection        *slickClient.ConnectionInfo        `json:"slickConnection,omitempty"`
+	Configuration          ConfigurationRevision              `json:"configuration"`
+}
+
+type ActionResult struct {
+	Name      string `json:"name"`
+	Parameter string `json:"parameter,omitempty"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	Duration  string `json:"duration"`
+}
+
+// Copy returns a copy of the status that shares none of its slices or maps, or the result to run.
+func (status AgentStatus) Copy() AgentStatus {
+	copied := status
+	copied.Provides = copyStrings(status.Provides)
+	copied.BrokenProvides = copyStrings(status.BrokenProvides)
+	copied.Groups = copyStrings(status.Groups)
+	if status.Projects != nil {
+		copied.Projects = make([]*slickqa.ProjectReleaseBuildInfo, len(status.Projects))
+		copy(copied.Projects, status.Projects)
+	}
+	copied.Versions = copyStringMap(status.Versions)
+	copied.RequiredTestAttributes = copyStringMap(status.RequiredTestAttributes)
+	copied.Attributes = copyStringMap(status.Attributes)
+	if status.ResultToRun != nil {
+		result := *status.ResultToRun
+		copied.ResultToRun = &result
+	}
+	return copied
+}
+
+func copyStrings(original []string) []string {
+	if original == nil {
+		return nil
+	}
+	copied := make([]string, len(original))
+	copy(copied, original)
+	return copied
+}
+
+func copyStringMap(original map[string]string) map[string]string {
+	if original == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(original))
+	for k, v := range original {
+		copied[k] = v
+	}
+	return copied
+}
+
+func (status *AgentStatus) getNonBrokenProvides() []string {
+	var exists = struct{}{}
+	providesSet := make(map[string]struct{})
+	for _, provide := range status.Provides {
+		providesSet[provide] = exists
+	}
+	for _, broken := range status.BrokenProvides {
+		delete(providesSet, broken)
+	}
+
+	provides := make([]string, len(providesSet))
+	i := 0
+	for provide := range providesSet {
+		provides[i] = provide
+		i++
+	}
+	return provides
+}
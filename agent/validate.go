@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/slickqa/slick-agent/slickClient"
+	"gopkg.in/yaml.v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// phaseSources are the sources a phase can have, in the order Source checks them.
+var phaseSources = []string{"plugin", "command", "write-file", "http-url", "read-file", "static-value", "static-list", "static-map"}
+
+// staticTargets says which static sources each phase has somewhere to put.  It has to match the targets the
+// Handle functions give applyPhase, ApplyToStatus rejects or ignores the others when the phase runs.
+var staticTargets = map[string][]string{
+	"loop-start":               nil,
+	"check-for-action":         {"static-value"},
+	"action-map":               nil,
+	"on-success":               nil,
+	"on-failure":               nil,
+	"test-attribute-discovery": {"static-map"},
+	"discovery":                {"static-value", "static-list"},
+	"broke-discovery":          {"static-value", "static-list"},
+	"update-status":            nil,
+	"get-status":               {"static-value"},
+	"before-get-test":          nil,
+	"get-test":                 nil,
+	"run-test":                 nil,
+	"no-test":                  nil,
+	"cleanup":                  nil,
+}
+
+// Validate reads the configuration from the file or url in the options, the same way the agent does, and
+// returns the problems ValidateConfiguration finds in it.  The error is for a configuration that can't be read.
+func Validate(options Options) ([]string, error) {
+	var auth slickClient.Authorizer
+	client := optionsClient(&options)
+	if client != nil {
+		defer client.Close()
+		auth = client
+	}
+	loaded, err := readConfiguration(&options, auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ValidateConfiguration([]byte(loaded.Content)), nil
+}
+
+// ValidateConfiguration checks a configuration more strictly than LoadConfiguration, which ignores what it
+// doesn't understand so a running agent keeps going.  Keys that aren't part of the configuration, durations
+// that don't parse, phases without exactly one source, static sources the phase has nowhere to put and
+// actions that aren't in the action-map are all problems.  Nothing is returned for a valid configuration.
+func ValidateConfiguration(content []byte) []string {
+	var problems []string
+	config, _ := DefaultConfiguration()
+	err := yaml.UnmarshalStrict(content, &config)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// the rest of the document was still decoded, so it can be checked too
+		problems = append(problems, typeErr.Errors...)
+	} else if err != nil {
+		return []string{err.Error()}
+	}
+
+	phases := []struct {
+		name   string
+		phases []PhaseConfiguration
+	}{
+		{"loop-start", config.LoopStart},
+		{"check-for-action", config.CheckForAction},
+		{"test-attribute-discovery", config.TestAttributeDiscovery},
+		{"discovery", config.Discovery},
+		{"broke-discovery", config.BrokenDiscovery},
+		{"update-status", config.UpdateStatus},
+		{"get-status", config.GetStatus},
+		{"before-get-test", config.BeforeGetTest},
+		{"get-test", config.GetTest},
+		{"run-test", config.RunTest},
+		{"no-test", config.NoTest},
+		{"cleanup", config.Cleanup},
+	}
+	for _, list := range phases {
+		for i := range list.phases {
+			problems = append(problems, validatePhase(fmt.Sprintf("%s[%d]", list.name, i), list.name, &list.phases[i])...)
+		}
+	}
+
+	actions := make([]string, 0, len(config.ActionMap))
+	for name := range config.ActionMap {
+		actions = append(actions, name)
+	}
+	sort.Strings(actions)
+	for _, name := range actions {
+		action := config.ActionMap[name]
+		path := "action-map." + name
+		problems = append(problems, validatePhase(path, "action-map", &action.PhaseConfiguration)...)
+		for i := range action.OnSuccess {
+			problems = append(problems, validatePhase(fmt.Sprintf("%s.on-success[%d]", path, i), "on-success", &action.OnSuccess[i])...)
+		}
+		for i := range action.OnFailure {
+			problems = append(problems, validatePhase(fmt.Sprintf("%s.on-failure[%d]", path, i), "on-failure", &action.OnFailure[i])...)
+		}
+	}
+	for i, phase := range config.CheckForAction {
+		if phase.Source() == "static-value" {
+			if _, ok := config.ActionMap[phase.StaticValue]; !ok {
+				problems = append(problems, fmt.Sprintf("check-for-action[%d]: action %#v is not in the action-map", i, phase.StaticValue))
+			}
+		}
+	}
+
+	durations := []struct {
+		path  string
+		value string
+	}{
+		{"check-for-configuration-every", config.CheckForConfigurationEvery},
+		{"sleep.after-test", config.Sleep.AfterTest},
+		{"sleep.no-test", config.Sleep.NoTest},
+		{"shutdown-grace-period", config.ShutdownGracePeriod},
+		{"slick.request-timeout", config.Slick.RequestTimeout},
+	}
+	for _, duration := range durations {
+		problems = append(problems, validateDuration(duration.path, duration.value)...)
+	}
+	phaseNames := make([]string, 0, len(config.Timeouts))
+	for phase := range config.Timeouts {
+		phaseNames = append(phaseNames, phase)
+	}
+	sort.Strings(phaseNames)
+	for _, phase := range phaseNames {
+		if _, ok := staticTargets[phase]; !ok {
+			problems = append(problems, fmt.Sprintf("timeouts.%s: there is no %s phase", phase, phase))
+		}
+		problems = append(problems, validateDuration("timeouts."+phase, config.Timeouts[phase])...)
+	}
+
+	if config.Slick.Queue != "" && !contains(slickClient.Queues, config.Slick.Queue) {
+		problems = append(problems, fmt.Sprintf("slick.queue: there is no %s queue, use one of %s", config.Slick.Queue, strings.Join(slickClient.Queues, ", ")))
+	}
+	if config.MaxCommandOutput < 0 {
+		problems = append(problems, fmt.Sprintf("max-command-output: %d is negative", config.MaxCommandOutput))
+	}
+	if config.Executors < 0 {
+		problems = append(problems, fmt.Sprintf("executors: %d is negative", config.Executors))
+	}
+	return problems
+}
+
+// validatePhase checks one phase configuration from the list at path, in the named phase.
+func validatePhase(path string, name string, phase *PhaseConfiguration) []string {
+	var problems []string
+	var sources []string
+	set := map[string]bool{
+		"plugin":       phase.Plugin != "",
+		"command":      phase.Command != "",
+		"write-file":   phase.WriteFile != "",
+		"http-url":     phase.HttpUrl != "",
+		"read-file":    phase.ReadFile != "",
+		"static-value": phase.StaticValue != "",
+		"static-list":  len(phase.StaticList) > 0,
+		"static-map":   len(phase.StaticMap) > 0,
+	}
+	for _, source := range phaseSources {
+		if set[source] {
+			sources = append(sources, source)
+		}
+	}
+	switch {
+	case len(sources) == 0:
+		problems = append(problems, fmt.Sprintf("%s: no source, set one of %s", path, strings.Join(phaseSources, ", ")))
+	case len(sources) > 1:
+		problems = append(problems, fmt.Sprintf("%s: more than one source (%s), only %s would be used", path, strings.Join(sources, ", "), sources[0]))
+	}
+	if len(sources) > 0 && strings.HasPrefix(sources[0], "static-") && !contains(staticTargets[name], sources[0]) {
+		problems = append(problems, fmt.Sprintf("%s: %s can't be used in %s phases, they have nowhere to put it", path, sources[0], name))
+	}
+	if phase.Timeout != "" {
+		problems = append(problems, validateDuration(path+".timeout", phase.Timeout)...)
+	}
+	if phase.When != "" {
+		if _, err := parseWhen(phase.When); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.when: %s", path, err))
+		}
+	}
+	return problems
+}
+
+func validateDuration(path string, value string) []string {
+	if _, err := time.ParseDuration(value); err != nil {
+		return []string{fmt.Sprintf("%s: %s", path, err)}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A when expression decides whether a phase runs.  It's evaluated against the status document command phases
+// see, with the os and arch the agent runs on added:
+//
+//	os == "linux"
+//	"android" in provides and not "android" in broken
+//	testcase.status != "PASS"
+//	action == "reboot" and actionParameter =~ "^device-[0-9]+$"
+//	slickQueueErrors > 3 or attributes.maintenance
+//
+// Names are paths into the status, like runStatus, attributes.os or testcase.testcase.name, and are null when
+// the status doesn't have them.  Strings are quoted with " or ', and numbers, true and false can be written
+// as they are.  The operators are:
+//
+//	==  !=           equal or not, comparing the values as text
+//	<  <=  >  >=     compare numbers, false when either side isn't one
+//	=~  !~           match a regular expression or not
+//	in               an item of a list, a key of an object, or part of a string
+//	and  or  not     combine conditions, with ( and ) for grouping
+//
+// A value on its own is true unless it's null, false, 0, empty or missing.
+type whenExpression interface {
+	evaluate(context *whenContext) interface{}
+}
+
+// whenContext is the status an expression is evaluated against, and what it looked at, to explain the result.
+type whenContext struct {
+	document map[string]interface{}
+	looked   []string
+}
+
+type whenLiteral struct {
+	value interface{}
+}
+
+type whenName struct {
+	path string
+}
+
+type whenNot struct {
+	operand whenExpression
+}
+
+type whenOperator struct {
+	operator    string
+	left, right whenExpression
+}
+
+// Applies evaluates the phase's when expression against the status, always true when the phase has none.  The
+// explanation lists the values the expression looked at.
+func (conf *PhaseConfiguration) Applies(status *AgentStatus) (bool, string, error) {
+	if conf.When == "" {
+		return true, "", nil
+	}
+	expression, err := parseWhen(conf.When)
+	if err != nil {
+		return false, "", err
+	}
+	document, err := whenDocument(status)
+	if err != nil {
+		return false, "", err
+	}
+	context := &whenContext{document: document}
+	result := truthy(expression.evaluate(context))
+	return result, strings.Join(context.looked, ", "), nil
+}
+
+// whenDocument turns the status into the document expressions are evaluated against, the same json command
+// phases get.
+func whenDocument(status *AgentStatus) (map[string]interface{}, error) {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	document := make(map[string]interface{})
+	if err = json.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	document["os"] = runtime.GOOS
+	document["arch"] = runtime.GOARCH
+	return document, nil
+}
+
+func (literal whenLiteral) evaluate(context *whenContext) interface{} {
+	return literal.value
+}
+
+func (name whenName) evaluate(context *whenContext) interface{} {
+	var value interface{} = context.document
+	for _, key := range strings.Split(name.path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			value = nil
+			break
+		}
+		value = object[key]
+	}
+	shown, _ := json.Marshal(value)
+	context.looked = append(context.looked, fmt.Sprintf("%s = %s", name.path, shown))
+	return value
+}
+
+func (not whenNot) evaluate(context *whenContext) interface{} {
+	return !truthy(not.operand.evaluate(context))
+}
+
+func (operator whenOperator) evaluate(context *whenContext) interface{} {
+	left := operator.left.evaluate(context)
+	switch operator.operator {
+	case "and":
+		return truthy(left) && truthy(operator.right.evaluate(context))
+	case "or":
+		return truthy(left) || truthy(operator.right.evaluate(context))
+	}
+	right := operator.right.evaluate(context)
+	switch operator.operator {
+	case "==":
+		return text(left) == text(right)
+	case "!=":
+		return text(left) != text(right)
+	case "=~", "!~":
+		// the expression was checked when it was parsed, unless it came from the status
+		pattern, err := regexp.Compile(text(right))
+		return err == nil && pattern.MatchString(text(left)) == (operator.operator == "=~")
+	case "in":
+		switch container := right.(type) {
+		case []interface{}:
+			for _, item := range container {
+				if text(item) == text(left) {
+					return true
+				}
+			}
+			return false
+		case map[string]interface{}:
+			_, ok := container[text(left)]
+			return ok
+		case string:
+			return strings.Contains(container, text(left))
+		}
+		return false
+	}
+	leftNumber, leftErr := strconv.ParseFloat(text(left), 64)
+	rightNumber, rightErr := strconv.ParseFloat(text(right), 64)
+	if leftErr != nil || rightErr != nil {
+		return false
+	}
+	switch operator.operator {
+	case "<":
+		return leftNumber < rightNumber
+	case "<=":
+		return leftNumber <= rightNumber
+	case ">":
+		return leftNumber > rightNumber
+	default:
+		return leftNumber >= rightNumber
+	}
+}
+
+// text is how values are compared: as they'd be written in the expression, with null as nothing.
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false" && v != "0"
+	case float64:
+		return v != 0
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+var whenToken = regexp.MustCompile(`^\s*(==|!=|=~|!~|<=|>=|<|>|\(|\)|"(?:[^"\\]|\\.)*"|'[^']*'|[A-Za-z0-9_.\-]+)`)
+
+var whenWord = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+type whenParser struct {
+	tokens   []string
+	position int
+}
+
+// parseWhen parses a when expression, see whenExpression for what it can contain.
+func parseWhen(expression string) (whenExpression, error) {
+	parser := &whenParser{}
+	rest := expression
+	for strings.TrimSpace(rest) != "" {
+		match := whenToken.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("%#v: unexpected %#v", expression, strings.TrimSpace(rest))
+		}
+		parser.tokens = append(parser.tokens, match[1])
+		rest = rest[len(match[0]):]
+	}
+	parsed, err := parser.or()
+	if err == nil && parser.position < len(parser.tokens) {
+		err = parser.fail("expected and, or or the end")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%#v: %s", expression, err)
+	}
+	return parsed, nil
+}
+
+func (parser *whenParser) peek() string {
+	if parser.position < len(parser.tokens) {
+		return parser.tokens[parser.position]
+	}
+	return ""
+}
+
+func (parser *whenParser) next() string {
+	token := parser.peek()
+	parser.position++
+	return token
+}
+
+func (parser *whenParser) fail(message string) error {
+	if parser.position >= len(parser.tokens) {
+		return fmt.Errorf("%s, not the end", message)
+	}
+	return fmt.Errorf("%s, not %s", message, parser.tokens[parser.position])
+}
+
+func (parser *whenParser) or() (whenExpression, error) {
+	left, err := parser.and()
+	for err == nil && parser.peek() == "or" {
+		parser.next()
+		var right whenExpression
+		right, err = parser.and()
+		left = whenOperator{operator: "or", left: left, right: right}
+	}
+	return left, err
+}
+
+func (parser *whenParser) and() (whenExpression, error) {
+	left, err := parser.not()
+	for err == nil && parser.peek() == "and" {
+		parser.next()
+		var right whenExpression
+		right, err = parser.not()
+		left = whenOperator{operator: "and", left: left, right: right}
+	}
+	return left, err
+}
+
+func (parser *whenParser) not() (whenExpression, error) {
+	if parser.peek() == "not" {
+		parser.next()
+		operand, err := parser.not()
+		return whenNot{operand: operand}, err
+	}
+	return parser.comparison()
+}
+
+func (parser *whenParser) comparison() (whenExpression, error) {
+	left, err := parser.value()
+	if err != nil {
+		return nil, err
+	}
+	switch operator := parser.peek(); operator {
+	case "==", "!=", "=~", "!~", "<", "<=", ">", ">=", "in":
+		parser.next()
+		right, err := parser.value()
+		if err != nil {
+			return nil, err
+		}
+		if literal, ok := right.(whenLiteral); ok && (operator == "=~" || operator == "!~") {
+			if _, err := regexp.Compile(text(literal.value)); err != nil {
+				return nil, err
+			}
+		}
+		return whenOperator{operator: operator, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (parser *whenParser) value() (whenExpression, error) {
+	token := parser.peek()
+	switch {
+	case token == "":
+		return nil, parser.fail("expected a value")
+	case token == "(":
+		parser.next()
+		inner, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ")" {
+			return nil, parser.fail("expected )")
+		}
+		parser.next()
+		return inner, nil
+	case strings.HasPrefix(token, `"`):
+		parser.next()
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s", err, token)
+		}
+		return whenLiteral{value: value}, nil
+	case strings.HasPrefix(token, "'"):
+		parser.next()
+		return whenLiteral{value: token[1 : len(token)-1]}, nil
+	case token == "true" || token == "false":
+		parser.next()
+		return whenLiteral{value: token == "true"}, nil
+	case token == "and" || token == "or" || token == "not" || token == "in" || !whenWord.MatchString(token):
+		return nil, parser.fail("expected a value")
+	}
+	parser.next()
+	if _, err := strconv.ParseFloat(token, 64); err == nil {
+		return whenLiteral{value: token}, nil
+	}
+	return whenName{path: token}, nil
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func whenTestDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"os":               "linux",
+		"ranTest":          true,
+		"runStatus":        "IDLE",
+		"provides":         []interface{}{"android", "camera"},
+		"broken":           []interface{}{},
+		"attributes":       map[string]interface{}{"pool": "nightly", "maintenance": ""},
+		"slickQueueErrors": float64(4),
+		"action":           "reboot",
+		"actionParameter":  "device-12",
+		"testcase":         map[string]interface{}{"status": "FAIL"},
+	}
+}
+
+func TestWhenEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		// values on their own
+		{`ranTest`, true},
+		{`missing`, false},
+		{`attributes.maintenance`, false},
+		{`attributes.pool`, true},
+		{`broken`, false},
+		{`true`, true},
+		{`0`, false},
+
+		// precedence: not binds tighter than and, which binds tighter than or
+		{`true or false and false`, true},
+		{`(true or false) and false`, false},
+		{`not false and false`, false},
+		{`not (false and false)`, true},
+		{`false or not ranTest or runStatus == "IDLE"`, true},
+
+		// in, and not ... in
+		{`"android" in provides`, true},
+		{`"tablet" in provides`, false},
+		{`not "android" in provides`, false},
+		{`not "tablet" in provides`, true},
+		{`"android" in provides and not "android" in broken`, true},
+		{`"pool" in attributes`, true},
+		{`"inu" in os`, true},
+		{`"android" in missing`, false},
+
+		// quoting
+		{`os == "linux"`, true},
+		{`os == 'linux'`, true},
+		{`"say \"hi\"" == 'say "hi"'`, true},
+		{`"a\tb" == "a	b"`, true},
+		{`'\t' == "\\t"`, true},
+		{`"and" != 'or'`, true},
+
+		// comparisons
+		{`slickQueueErrors > 3`, true},
+		{`slickQueueErrors >= 4`, true},
+		{`slickQueueErrors < 4`, false},
+		{`slickQueueErrors <= 4.0`, true},
+		{`slickQueueErrors == 4`, true},
+		{`slickQueueErrors != "4"`, false},
+		{`"10" > "9"`, true},
+		{`os > 3`, false},
+		{`os < 3`, false},
+		{`missing < 3`, false},
+		{`testcase.status != "PASS"`, true},
+		{`missing == ""`, true},
+
+		// regular expressions
+		{`actionParameter =~ "^device-[0-9]+$"`, true},
+		{`actionParameter !~ "^device-[0-9]+$"`, false},
+		{`action =~ 'boot'`, true},
+		{`os !~ "^win"`, true},
+		{`os =~ runStatus`, false},
+		{`os =~ attributes.pool`, false},
+	}
+	for _, test := range tests {
+		expression, err := parseWhen(test.expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.expression, err)
+			continue
+		}
+		context := &whenContext{document: whenTestDocument()}
+		if result := truthy(expression.evaluate(context)); result != test.expected {
+			t.Errorf("%s: expected %t, got %t (%s)", test.expression, test.expected, result, strings.Join(context.looked, ", "))
+		}
+	}
+}
+
+func TestWhenParseErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		message    string
+	}{
+		{`os ==`, `"os ==": expected a value, not the end`},
+		{`== "linux"`, `"== \"linux\"": expected a value, not ==`},
+		{`os == "linux" os`, `"os == \"linux\" os": expected and, or or the end, not os`},
+		{`(os == "linux"`, `"(os == \"linux\"": expected ), not the end`},
+		{`os == "linux")`, `"os == \"linux\")": expected and, or or the end, not )`},
+		{`ranTest and`, `"ranTest and": expected a value, not the end`},
+		{`not`, `"not": expected a value, not the end`},
+		{`"android" in`, `"\"android\" in": expected a value, not the end`},
+		{`in provides`, `"in provides": expected a value, not in`},
+		{`os = "linux"`, `"os = \"linux\"": unexpected "= \"linux\""`},
+		{`os == "linux`, `"os == \"linux": unexpected "\"linux"`},
+		{`os == 'linux`, `"os == 'linux": unexpected "'linux"`},
+		{`os == 'it''s'`, `"os == 'it''s'": expected and, or or the end, not 's'`},
+		{`os == "\q"`, `"os == \"\\q\"": invalid syntax in "\q"`},
+		{`os =~ "[a-"`, "\"os =~ \\\"[a-\\\"\": error parsing regexp: missing closing ]: `[a-`"},
+		{`os !~ "(linux"`, "\"os !~ \\\"(linux\\\"\": error parsing regexp: missing closing ): `(linux`"},
+	}
+	for _, test := range tests {
+		_, err := parseWhen(test.expression)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.expression)
+		} else if err.Error() != test.message {
+			t.Errorf("%s: expected error %s, got %s", test.expression, test.message, err)
+		}
+	}
+}
+
+func TestWhenApplies(t *testing.T) {
+	status := &AgentStatus{RanTest: true, Provides: []string{"android"}, ResultToRun: &Result{Status: "FAIL"}}
+	tests := []struct {
+		when        string
+		expected    bool
+		explanation string
+	}{
+		{``, true, ``},
+		{`ranTest and testcase.status != "PASS"`, true, `ranTest = true, testcase.status = "FAIL"`},
+		{`"android" in provides and not ranTest`, false, `provides = ["android"], ranTest = true`},
+		{`missing.value`, false, `missing.value = null`},
+	}
+	for _, test := range tests {
+		conf := &PhaseConfiguration{When: test.when}
+		applies, explanation, err := conf.Applies(status)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.when, err)
+		} else if applies != test.expected || explanation != test.explanation {
+			t.Errorf("%s: expected %t (%s), got %t (%s)", test.when, test.expected, test.explanation, applies, explanation)
+		}
+	}
+}
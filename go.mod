@@ -14,7 +14,8 @@ require (
 	github.com/namsral/flag v1.7.4-pre
 	github.com/pelletier/go-toml v1.6.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/rs/zerolog v1.17.2 // indirect
+	github.com/prometheus/client_golang v1.5.1
+	github.com/rs/zerolog v1.17.2
 	github.com/slickqa/screenshot v0.0.0-20181114150205-dc201b676cb9
 	github.com/slickqa/slick v0.0.0-20191111181657-c11d35a170e7
 	github.com/srikrsna/protoc-gen-gotag v0.5.0 // indirect
@@ -25,5 +26,6 @@ require (
 	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82 // indirect
 	google.golang.org/genproto v0.0.0-20200122232147-0452cf42e150 // indirect
 	google.golang.org/grpc v1.26.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v2 v2.2.8
 )
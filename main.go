@@ -1,825 +1,149 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/namsral/flag"
-	"github.com/slickqa/screenshot"
-	"github.com/slickqa/slick-agent/slickClient"
-	"github.com/slickqa/slick/slickqa"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/slickqa/slick-agent/agent"
 	"golang.org/x/net/context"
 	"gopkg.in/yaml.v2"
-	"image/png"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"regexp"
-	"runtime"
-	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	log.Println("================= Initializing Agent =================")
-
 	var groups string
-
-	if runtime.GOOS == "windows" {
-		ProgramOptions.ShellCommand = "cmd.exe"
-		ProgramOptions.ShellOpt = "/C"
-	} else {
-		ProgramOptions.ShellCommand = "/bin/bash"
-		ProgramOptions.ShellOpt = "-c"
+	options := agent.DefaultOptions()
+	// slick-agent validate --conf ... checks the configuration instead of running the agent
+	args := os.Args[1:]
+	validate := len(args) > 0 && args[0] == "validate"
+	if validate {
+		args = args[1:]
 	}
 
 	parser := flag.NewFlagSetWithEnvPrefix(os.Args[0], "SLICK_AGENT", 0)
-	parser.StringVar(&ProgramOptions.ConfigurationLocation, "conf", "", "configuration location")
+	parser.StringVar(&options.ConfigurationLocation, "conf", "", "configuration location")
+	parser.StringVar(&options.ConfigurationCache, "conf-cache", "", "File the last configuration that loaded is kept in, used when the configuration can't be loaded.  Defaults to one in the user's cache directory, none turns it off.")
+	parser.BoolVar(&options.ConfigurationAuth, "conf-auth", false, "Send the slick token with a configuration url that isn't on the grpc url's host.")
+	parser.StringVar(&options.APIKey, "api-key", "", "Slick api key, used to fetch the configuration and when the configuration has none.")
+	parser.StringVar(&options.GrpcUrl, "grpc-url", "", "Slick grpc url, used to fetch the configuration and when the configuration has none.")
+	parser.StringVar(&options.TLS.CAFile, "tls-ca-file", "", "Certificate authorities to trust for the slick grpc connection, when the configuration has none.")
+	parser.StringVar(&options.TLS.CertFile, "tls-cert-file", "", "Client certificate for the slick grpc connection, when the configuration has none.")
+	parser.StringVar(&options.TLS.KeyFile, "tls-key-file", "", "Client key for the slick grpc connection, when the configuration has none.")
+	parser.StringVar(&options.TLS.ServerName, "tls-server-name", "", "Name to verify slick's certificate against, when the configuration has none.")
+	parser.BoolVar(&options.TLS.Insecure, "tls-insecure", false, "Don't verify slick's certificate.")
+	parser.BoolVar(&options.TLS.Plaintext, "grpc-plaintext", false, "Connect to slick's grpc api without tls.")
 	parser.StringVar(&groups, "groups", "", "comma separated list of groups")
-	parser.StringVar(&ProgramOptions.ShellCommand, "shell", ProgramOptions.ShellCommand, "Shell to use for command execution.")
-	parser.StringVar(&ProgramOptions.ShellOpt, "shell-arg", ProgramOptions.ShellOpt, "Option to pass to shell for command execution.")
-	parser.BoolVar(&ProgramOptions.Debug, "debug", false, "Enable debug logging for extra info.")
-	err := parser.Parse(os.Args[1:])
+	parser.StringVar(&options.ShellCommand, "shell", options.ShellCommand, "Shell to use for command execution.")
+	parser.StringVar(&options.ShellOpt, "shell-arg", options.ShellOpt, "Option to pass to shell for command execution.")
+	parser.BoolVar(&options.Debug, "debug", false, "Enable debug logging for extra info.")
+	parser.StringVar(&options.LogFormat, "log-format", "text", "Log format, text or json.")
+	parser.StringVar(&options.LogFile, "log-file", "", "Log to this file instead of stderr, rotating it as it grows.")
+	parser.IntVar(&options.LogMaxSize, "log-max-size", 100, "Size in megabytes the log file is rotated at.")
+	parser.IntVar(&options.LogMaxBackups, "log-max-backups", 5, "Number of rotated log files to keep.")
+	err := parser.Parse(args)
 	if err != nil {
 		log.Fatalf("Unable to parse command line arguments: %s", err.Error())
 	}
-
-	if groups != "" {
-		ProgramOptions.Groups = regexp.MustCompile(",[ ]?").Split(groups, -1)
-	} else {
-		ProgramOptions.Groups = make([]string, 0)
-	}
-
-	debug("Program Options: \n%+v", ProgramOptions)
-	log.Printf("Loading Configuration from %s", ProgramOptions.ConfigurationLocation)
-
-	agent := Agent{}
-	agent.Config, agent.Cache, err = LoadConfiguration()
-	if err != nil {
-		log.Fatalf("Error loading configuration: %s", err.Error())
-	}
-
-	if agent.Config.Slick.GrpcUrl != "" {
-		agent.Slick, err = slickClient.CreateClient(agent.Config.Slick.GrpcUrl, agent.Config.APIKey)
-		if err != nil {
-			log.Printf("Error creating slick client: %s", err)
-		}
-	}
-
-	agent.LastConfigurationCheck = time.Now()
-	output, _ := yaml.Marshal(agent.Config)
-	log.Printf("Configuration:\n%s", string(output))
-
-	go agent.startScreenShots()
-	for !agent.Status.ShouldExit {
-		debugln("Top of loop, initializing status.")
-		agent.Status = agent.DefaultStatus()
-		agent.CheckConfiguration()
-		agent.HandleLoopStart()
-		agent.HandleCheckForAction()
-		if agent.Status.Action != "" {
-			agent.HandlePerformAction()
-		}
-		agent.HandleDiscoverTestAttributes()
-		agent.HandleDiscovery()
-		agent.HandleBrokenDiscovery()
-		agent.HandleGetCurrentStatus()
-		agent.HandleStatusUpdate()
-		agent.RanTest = false
-		if agent.Status.RunStatus == "IDLE" {
-			agent.HandleBeforeGetTest()
-			agent.HandleGetTest()
-			if agent.Status.ResultToRun != nil {
-				agent.RanTest = true
-				agent.Status.RunStatus = "RUNNING"
-				agent.HandleStatusUpdate()
-				agent.HandleRunTest()
-			} else {
-				agent.HandleNoTest()
-			}
-			agent.HandleStatusUpdate()
-		}
-		agent.HandleCleanup()
-		agent.HandleSleep()
+	if options.LogFormat != "text" && options.LogFormat != "json" {
+		log.Fatalf("Unknown log format %#v, use text or json.", options.LogFormat)
 	}
-	log.Println("Agent requested to exit!")
-}
 
-var (
-	ProgramOptions struct {
-		ConfigurationLocation string
-		Groups                []string
-		Debug                 bool
-		ShellCommand          string
-		ShellOpt              string
+	logger := agent.NewLogger(options)
+	options.Logger = &logger
+	zlog.Logger = logger
+	// libraries that use the standard logger end up in the same log
+	log.SetFlags(0)
+	log.SetOutput(logger)
+	if validate {
+		os.Exit(validateConfiguration(options))
 	}
-)
-
-type AgentStatus struct {
-	Provides               []string                           `json:"provides"`
-	BrokenProvides         []string                           `json:"broken"`
-	RunStatus              string                             `json:"runStatus"`
-	Projects               []*slickqa.ProjectReleaseBuildInfo //[]ProjectReleaseBuild `json:"projects,omitempty"`
-	Versions               map[string]string                  `json:"versions,omitempty"`
-	Hardware               string                             `json:"hardware,omitempty"`
-	RequiredTestAttributes map[string]string                  `json:"requiredAttrs,omitempty"`
-	RanTest                bool                               `json:"ranTest"`
-	Action                 string                             `json:"action,omitempty"`
-	ActionParameter        string                             `json:"actionParameter,omitempty"`
-	IP                     string                             `json:"IP,omitempty"`
-	Attributes             map[string]string                  `json:"attributes"`
-	ResultToRun            map[string]interface{}             `json:"testcase"`
-	Groups                 []string                           `json:"groups"`
-	ShouldExit             bool                               `json:"shouldExit"`
-	AgentName              string                             `json:"agentName"`
-}
-
-type ProjectReleaseBuild struct {
-	Name    string `json:"name" yaml:"name"`
-	Release string `json:"release,omitempty" yaml:"release,omitempty"`
-	Build   string `json:"build,omitempty" yaml:"build,omitempty"`
-}
-
-type AgentConfiguration struct {
-	Company                    string                        `yaml:"company,omitempty"`
-	APIKey                     string                        `yaml:"api-key,omitempty"`
-	Groups                     []string                      `yaml:"groups,omitempty"`
-	Projects                   []ProjectReleaseBuild         `yaml:"projects,omitempty"`
-	LoopStart                  []PhaseConfiguration          `yaml:"loop-start,omitempty"`
-	CheckForAction             []PhaseConfiguration          `yaml:"check-for-action,omitempty"`
-	TestAttributeDiscovery     []PhaseConfiguration          `yaml:"test-attribute-discovery,omitempty"`
-	Discovery                  []PhaseConfiguration          `yaml:"discovery,omitempty"`
-	BrokenDiscovery            []PhaseConfiguration          `yaml:"broke-discovery,omitempty"`
-	GetStatus                  []PhaseConfiguration          `yaml:"get-status,omitempty"`
-	UpdateStatus               []PhaseConfiguration          `yaml:"update-status,omitempty"`
-	RunTest                    []PhaseConfiguration          `yaml:"run-test,omitempty"`
-	NoTest                     []PhaseConfiguration          `yaml:"no-test,omitempty"`
-	Cleanup                    []PhaseConfiguration          `yaml:"cleanup,omitempty"`
-	ActionMap                  map[string]PhaseConfiguration `yaml:"action-map,omitempty"`
-	BeforeGetTest              []PhaseConfiguration          `yaml:"before-get-test,omitempty"`
-	GetTest                    []PhaseConfiguration          `yaml:"get-test,omitempty"`
-	Slick                      SlickConfiguration            `yaml:"slick,omitempty"`
-	CheckForConfigurationEvery string                        `yaml:"check-for-configuration-every,omitempty"`
-	Sleep                      SleepConfiguration            `yaml:"sleep,omitempty"`
-}
+	logger.Info().Msg("================= Initializing Agent =================")
 
-type ParsedConfigurationOptions struct {
-	Sleep                      ParsedSleepOptions
-	CheckForConfigurationEvery time.Duration
-}
-
-type ParsedSleepOptions struct {
-	AfterTest time.Duration
-	NoTest    time.Duration
-}
-
-type Agent struct {
-	Config                 AgentConfiguration
-	Status                 AgentStatus
-	LastConfigurationCheck time.Time
-	RanTest                bool
-	Cache                  ParsedConfigurationOptions
-	Slick                  *slickClient.SlickClient
-}
-
-type SlickConfiguration struct {
-	BaseUrl   string `yaml:"base-url"`
-	GrpcUrl   string `yaml:"grpc-url"`
-	AgentName string `yaml:"agent-name"`
-}
-
-type PhaseConfiguration struct {
-	HttpUrl     string            `yaml:"http-url,omitempty"`
-	Command     string            `yaml:"command,omitempty"`
-	WriteFile   string            `yaml:"write-file,omitempty"`
-	ReadFile    string            `yaml:"read-file,omitempty"`
-	StaticList  []string          `yaml:"static-list,omitempty,flow"`
-	StaticMap   map[string]string `yaml:"static-map,omitempty"`
-	StaticValue string            `yaml:"static-value,omitempty"`
-}
-
-type SleepConfiguration struct {
-	AfterTest string `yaml:"after-test,omitempty"`
-	NoTest    string `yaml:"no-test,omitempty"`
-}
-
-type TestcaseInfo struct {
-	Id           string
-	Name         string
-	AutomationId string
-	TestrunId    string
-}
-
-func DefaultConfiguration() (AgentConfiguration, ParsedConfigurationOptions) {
-	return AgentConfiguration{
-			CheckForConfigurationEvery: "5s",
-			Sleep: SleepConfiguration{
-				AfterTest: "500ms",
-				NoTest:    "2s",
-			},
-			Slick: SlickConfiguration{},
-		}, ParsedConfigurationOptions{
-			CheckForConfigurationEvery: 5 * time.Second,
-			Sleep: ParsedSleepOptions{
-				AfterTest: 500 * time.Millisecond,
-				NoTest:    2 * time.Second,
-			},
-		}
-}
-
-func LoadConfiguration() (AgentConfiguration, ParsedConfigurationOptions, error) {
-	config, parsed := DefaultConfiguration()
-	var err error
-
-	if strings.HasPrefix(ProgramOptions.ConfigurationLocation, "http") {
-		debug("Determined configuration is a url, fetching %#v", ProgramOptions.ConfigurationLocation)
-		response, err := http.Get(ProgramOptions.ConfigurationLocation)
-		if err == nil {
-			if response.StatusCode == 200 {
-				debug("Reading %d bytes from body of response from %#v", response.ContentLength, ProgramOptions.ConfigurationLocation)
-				buf, err := ioutil.ReadAll(response.Body)
-				if err == nil {
-					err = yaml.Unmarshal(buf, &config)
-				}
-			} else {
-				debug("Response had a bad status code of %d.  Full response:\n%+v", response.StatusCode, response)
-				err = errors.New(fmt.Sprintf("http status code was %d", response.StatusCode))
-			}
-		}
-	} else {
-		buf, err := ioutil.ReadFile(ProgramOptions.ConfigurationLocation)
-		if err == nil {
-			err = yaml.Unmarshal(buf, &config)
-		}
-	}
-
-	if err == nil {
-		if config.Slick.AgentName == "" {
-			config.Slick.AgentName = os.Getenv("SLICK_AGENT_NAME")
-			if config.Slick.AgentName == "" {
-				config.Slick.AgentName, _ = os.Hostname()
-			}
-		}
-		d, err := time.ParseDuration(config.CheckForConfigurationEvery)
-		if err == nil {
-			parsed.CheckForConfigurationEvery = d
-		} else {
-			log.Printf("Using default of 5 seconds, Error in check-for-configuration-every %#v: %s", config.CheckForConfigurationEvery, err.Error())
-		}
-
-		d, err = time.ParseDuration(config.Sleep.AfterTest)
-		if err == nil {
-			parsed.Sleep.AfterTest = d
-		} else {
-			log.Printf("Using default of 500 milliseconds, Error in sleep.after-test %#v: %s", config.Sleep.AfterTest, err.Error())
-		}
-		d, err = time.ParseDuration(config.Sleep.NoTest)
-		if err == nil {
-			parsed.Sleep.NoTest = d
-		} else {
-			log.Printf("Using default of 2 seconds, Error in sleep.no-test %#v: %s", config.Sleep.NoTest, err.Error())
-		}
-		// hide parsing errors since we use defaults
-		err = nil
+	options.Secrets.Add(options.APIKey)
+	if groups != "" {
+		options.Groups = regexp.MustCompile(",[ ]?").Split(groups, -1)
 	}
-	debug("Loaded Configuration:\n%+v\nParsed Configuration: %+v, Error: %+v", config, parsed, err)
-	return config, parsed, err
-}
 
-func (agent *Agent) DefaultStatus() AgentStatus {
-	groups := make([]string, len(ProgramOptions.Groups))
-	projects := make([]*slickqa.ProjectReleaseBuildInfo, 0)
-	copy(groups, ProgramOptions.Groups)
-	for _, p := range agent.Config.Projects {
-		projects = append(projects, &slickqa.ProjectReleaseBuildInfo{Project: p.Name,
-			Build:   p.Build,
-			Release: p.Release})
-	}
-	return AgentStatus{
-		RunStatus:              "IDLE",
-		RanTest:                false,
-		Groups:                 groups,
-		Provides:               make([]string, 0),
-		BrokenProvides:         make([]string, 0),
-		Attributes:             make(map[string]string),
-		RequiredTestAttributes: make(map[string]string),
-		Projects:               projects,
-		AgentName:              agent.Config.Slick.AgentName,
+	if options.ConfigurationCache == "none" {
+		options.ConfigurationCache = ""
+	} else if options.ConfigurationCache == "" && options.ConfigurationLocation != "" {
+		options.ConfigurationCache = agent.DefaultConfigurationCache(options.ConfigurationLocation)
 	}
-}
-
-func (agent *Agent) CheckConfiguration() {
-	debug("Checking to see if we need to reload config.  Last check happened at %s", agent.LastConfigurationCheck.String())
-	if time.Now().After(agent.LastConfigurationCheck.Add(agent.Cache.CheckForConfigurationEvery)) {
-		config, cache, err := LoadConfiguration()
-		if err == nil {
-			agent.Config = config
-			agent.Cache = cache
-		} else {
-			log.Printf("Error loading configuration, using old configuration: %s", err.Error())
-		}
-		agent.LastConfigurationCheck = time.Now()
-	}
-	if agent.Config.Groups != nil && len(agent.Config.Groups) > 0 {
-		var groups []string
-		groups = append(groups, ProgramOptions.Groups...)
-		groups = append(groups, agent.Config.Groups...)
-		agent.Status.Groups = groups
-	}
-}
 
-func (agent *Agent) HandleLoopStart() {
-	debug("Inside HandleLoopStart, there are %d configs to process.", len(agent.Config.LoopStart))
-	for _, phase := range agent.Config.LoopStart {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
-}
+	logger.Debug().Msgf("Program Options: \n%+v", options)
+	logger.Info().Msgf("Loading Configuration from %s", options.ConfigurationLocation)
 
-func (agent *Agent) HandleCheckForAction() {
-	debug("Inside HandleCheckForAction, there are %d configs to process.", len(agent.Config.CheckForAction))
-	for _, phase := range agent.Config.CheckForAction {
-		phase.ApplyToStatus(&agent.Status, &agent.Status.Action, nil, nil)
-	}
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info().Msgf("Received %s, finishing the current test before exiting.  Send it again to exit immediately.", sig)
+		cancel()
+		sig = <-signals
+		logger.Warn().Msgf("Received %s again, exiting immediately.", sig)
+		os.Exit(1)
+	}()
 
-func (agent *Agent) HandlePerformAction() {
-	debug("Inside HandlePerformAction, Action: %#v Parameter: %#v", agent.Status.Action, agent.Status.ActionParameter)
-	config, ok := agent.Config.ActionMap[agent.Status.Action]
-	if !ok {
-		log.Printf("Unable to find action %#v in action map %+v from configuration value action-map from %s", agent.Status.Action, agent.Config.ActionMap, ProgramOptions.ConfigurationLocation)
+	slickAgent := startAgent(ctx, options)
+	if slickAgent == nil {
 		return
 	}
-	config.ApplyToStatus(&agent.Status, nil, nil, nil)
-
-	// TODO handler for successful and unsuccessful action
-}
-
-func (agent *Agent) HandleDiscoverTestAttributes() {
-	debug("Inside HandleDiscoverTestAttributes, there are %d configs to process.", len(agent.Config.TestAttributeDiscovery))
-	for _, phase := range agent.Config.TestAttributeDiscovery {
-		phase.ApplyToStatus(&agent.Status, nil, nil, &agent.Status.RequiredTestAttributes)
-	}
-}
+	output, _ := yaml.Marshal(slickAgent.Config)
+	logger.Info().Msgf("Configuration:\n%s", string(output))
 
-func (agent *Agent) HandleDiscovery() {
-	debug("Inside HandleDiscovery, there are %d configs to process.", len(agent.Config.Discovery))
-	for _, phase := range agent.Config.Discovery {
-		phase.ApplyToStatus(&agent.Status, nil, &agent.Status.Provides, nil)
-	}
+	slickAgent.Run(ctx)
 }
 
-func (agent *Agent) HandleBrokenDiscovery() {
-	debug("Inside HandleBrokenDiscovery, there are %d configs to process.", len(agent.Config.BrokenDiscovery))
-	for _, phase := range agent.Config.BrokenDiscovery {
-		phase.ApplyToStatus(&agent.Status, nil, &agent.Status.BrokenProvides, nil)
-	}
-}
-
-func (agent *Agent) HandleStatusUpdate() {
-	debug("Inside HandleStatusUpdate, there are %d configs to process.", len(agent.Config.UpdateStatus))
-	for _, phase := range agent.Config.UpdateStatus {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
-	// update slick
-	if agent.Slick != nil {
-		var currentTest slickqa.AgentCurrentTest
-		if agent.Status.ResultToRun != nil {
-			testInfo := GetTestInfo(agent.Status.ResultToRun)
-			testUrl := agent.Config.Slick.BaseUrl + "/testruns/" + testInfo.TestrunId + "?result=" + testInfo.Id
-			currentTest = slickqa.AgentCurrentTest{
-				Name:         testInfo.Name,
-				AutomationId: testInfo.AutomationId,
-				Url:          testUrl,
-			}
-
-		}
-		_, err := agent.Slick.Agents.UpdateStatus(context.Background(), &slickqa.AgentStatusUpdate{
-			Id: &slickqa.AgentId{Company: agent.Config.Company, Name: agent.Status.AgentName},
-			Status: &slickqa.AgentStatus{
-				Projects:    agent.Status.Projects,
-				RunStatus:   agent.Status.RunStatus,
-				CurrentTest: &currentTest,
-				Groups:      agent.Status.Groups,
-			},
-		})
-		if err != nil {
-			// re-connect?
-			agent.Slick.Close()
-			log.Printf("Trying to re-connect to slick")
-			slickClient, err := slickClient.CreateClient(agent.Config.Slick.GrpcUrl, agent.Config.APIKey)
-			if err != nil {
-				log.Printf("Error re-connecting to slick: %s", err)
-			} else {
-				agent.Slick = slickClient
-			}
-		}
-	}
-}
-
-func (agent *Agent) HandleGetCurrentStatus() {
-	debug("Inside HandleGetCurrentStatus, there are %d configs to process.", len(agent.Config.GetStatus))
-	if agent.Slick != nil {
-		resp, err := agent.Slick.Agents.GetAgentRunStatus(context.Background(), &slickqa.AgentId{Company: agent.Config.Company, Name: agent.Config.Slick.AgentName})
+// startAgent creates the agent, trying again with backoff when its configuration can't be loaded and there's no
+// cached one, so agents wait out an outage of the configuration server instead of exiting.  It returns nil if
+// ctx is cancelled first.
+func startAgent(ctx context.Context, options agent.Options) *agent.Agent {
+	wait := 5 * time.Second
+	for {
+		slickAgent, err := agent.New(options)
 		if err == nil {
-			agent.Status.RunStatus = resp.RunStatus
-		} else {
-			log.Printf("ERROR: problem occurred while trying to get run status from slick: %s", err.Error())
+			return slickAgent
 		}
-	}
-	for _, phase := range agent.Config.GetStatus {
-		phase.ApplyToStatus(&agent.Status, &agent.Status.RunStatus, nil, nil)
-	}
-}
-
-func (agent *Agent) HandleBeforeGetTest() {
-	debug("Inside HandleBeforeGetTest, there are %d configs to process.", len(agent.Config.BeforeGetTest))
-	for _, phase := range agent.Config.BeforeGetTest {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
-}
-
-func (status *AgentStatus) getNonBrokenProvides() []string {
-	var exists = struct{}{}
-	providesSet := make(map[string]struct{})
-	for _, provide := range status.Provides {
-		providesSet[provide] = exists
-	}
-	for _, broken := range status.BrokenProvides {
-		delete(providesSet, broken)
-	}
-
-	provides := make([]string, len(providesSet))
-	i := 0
-	for provide := range providesSet {
-		provides[i] = provide
-		i++
-	}
-	return provides
-}
-
-func (agent *Agent) RequestResultFromSlickQueue(query map[string]interface{}) map[string]interface{} {
-	var result map[string]interface{} = nil
-	jsonContentBody, err := json.Marshal(query)
-	if err != nil {
-		log.Printf("Error building query to slick for test: %s", err.Error())
-		return nil
-	}
-	url := agent.Config.Slick.BaseUrl + "/api/results/queue/" + agent.Config.Slick.AgentName
-	debug("URL: %s", url)
-	debug("JSON: %s", string(jsonContentBody))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonContentBody))
-	if err != nil {
-		log.Printf("Error making request to slick for test to run: %s", err.Error())
-		return nil
-	}
-	if resp.StatusCode == 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error occurred while trying to read response from slick: %s", err.Error())
+		options.Logger.Error().Msgf("Error loading configuration, trying again in %s: %s", wait, err.Error())
+		select {
+		case <-ctx.Done():
 			return nil
+		case <-time.After(wait):
 		}
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			log.Printf("Error occurred while trying to parse json from slick: %s", err.Error())
-			return nil
-		}
-		return result
-	}
-	debug("Response code from slick when requesting result from queue: %d", resp.StatusCode)
-	debug("Response:\n%+v", resp)
-	return nil
-}
-
-func (agent *Agent) HandleGetTest() {
-	debug("Inside HandleGetTest, there are %d configs to process.", len(agent.Config.GetTest))
-	if agent.Config.Slick.BaseUrl != "" {
-		// first get the test from slick, then call everything else
-		query := make(map[string]interface{})
-		query["provides"] = agent.Status.getNonBrokenProvides()
-		for key, value := range agent.Status.RequiredTestAttributes {
-			query[key] = value
-		}
-
-		if len(agent.Status.Projects) > 0 {
-			for _, project := range agent.Status.Projects {
-				projectQuery := query
-				projectQuery["project"] = project.Project
-				if project.Release != "" {
-					projectQuery["release"] = project.Release
-				}
-				if project.Build != "" {
-					projectQuery["build"] = project.Build
-				}
-				agent.Status.ResultToRun = agent.RequestResultFromSlickQueue(projectQuery)
-				if agent.Status.ResultToRun != nil {
-					break
-				}
-			}
-		} else {
-			agent.Status.ResultToRun = agent.RequestResultFromSlickQueue(query)
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
 		}
 	}
-
-	// TODO Handle the new go version of slick, when it's finished
-	for _, phase := range agent.Config.GetTest {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
-}
-
-func (agent *Agent) HandleRunTest() {
-	debug("Inside HandleRunTest, there are %d configs to process.  Current Test:\n%+v", len(agent.Config.RunTest), agent.Status.ResultToRun)
-	log.Printf("Running result: %+v", GetTestInfo(agent.Status.ResultToRun))
-	for _, phase := range agent.Config.RunTest {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
-	status := GetTestResult(agent.Status.ResultToRun)
-	if status == "" || status == "NO_RESULT" {
-		status = "UNKNOWN"
-	}
-	log.Printf("Result of test: %s", status)
-}
-
-func (agent *Agent) HandleNoTest() {
-	debug("Inside HandleNoTest, there are %d configs to process.", len(agent.Config.NoTest))
-	for _, phase := range agent.Config.NoTest {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
-}
-
-func (agent *Agent) HandleCleanup() {
-	debug("Inside HandleCleanup, there are %d configs to process.", len(agent.Config.Cleanup))
-	for _, phase := range agent.Config.Cleanup {
-		phase.ApplyToStatus(&agent.Status, nil, nil, nil)
-	}
 }
 
-func (agent *Agent) HandleSleep() {
-	if agent.RanTest {
-		debug("HandleSleep: After a test, sleeping %s", agent.Cache.Sleep.AfterTest)
-		time.Sleep(agent.Cache.Sleep.AfterTest)
-	} else {
-		debug("HandleSleep: No test ran, sleeping %s", agent.Cache.Sleep.NoTest)
-		time.Sleep(agent.Cache.Sleep.NoTest)
-	}
-}
-
-func uploadFile(filename string, url string, contentType string) {
-	data, err := os.Open(filename)
-	if err != nil {
-		log.Printf("Unable to open file %s: %s", filename, err)
-		return
-	}
-	defer data.Close()
-	stat, err := data.Stat()
-	if err != nil {
-		log.Printf("Unable to stat file %s after opening: %s", filename, err.Error())
-		return
-	}
-	req, err := http.NewRequest("PUT", url, data)
-	if err != nil {
-		log.Printf("Unable to create request to upload file %s to %s: %s", filename, url, err.Error())
-		return
+// validateConfiguration prints the problems in the configuration, returning the exit code for the validate mode.
+func validateConfiguration(options agent.Options) int {
+	if options.ConfigurationLocation == "" {
+		fmt.Println("Nothing to validate, use --conf to give the configuration file or url.")
+		return 2
 	}
-	req.Header.Set("Content-Type", contentType)
-	req.ContentLength = stat.Size()
-
-	client := &http.Client{}
-	res, err := client.Do(req)
+	problems, err := agent.Validate(options)
 	if err != nil {
-		log.Printf("Error uploading file %s to %s: %s", filename, url, err.Error())
-		return
+		fmt.Printf("Unable to read configuration from %s: %s\n", options.ConfigurationLocation, err)
+		return 2
 	}
-	defer res.Body.Close()
-}
-
-func (a *Agent) startScreenShots() {
-	//bounds := screenshot.GetDisplayBounds(0)
-	if a.Slick != nil {
-		var link *slickqa.Link = nil
-		screen, err := screenshot.CreateScreenshotUtility()
-		if err != nil {
-			log.Printf("Error initializing screenshots! %s", err.Error())
-			time.Sleep(5 * time.Second)
-			screen, err = screenshot.CreateScreenshotUtility()
-			if err != nil {
-				return
-			}
-		}
-		defer screen.Close()
-
-		links, err := a.Slick.Links.GetLinks(context.Background(), &slickqa.LinkListIdentity{Company: a.Config.Company, Project: "Agent", EntityType: "Agent", EntityId: a.Config.Slick.AgentName})
-		if err == nil && links != nil && links.Links != nil && len(links.Links) > 0 {
-			for _, potential := range links.Links {
-				if potential.Id.Name == "screen" {
-					link = potential
-					break
-				}
-			}
-		}
-		if link == nil {
-			link = &slickqa.Link{
-				Id: &slickqa.LinkIdentity{
-					Company:    a.Config.Company,
-					Project:    "Agent",
-					EntityType: "Agent",
-					EntityId:   a.Config.Slick.AgentName,
-					Name:       "screen",
-				},
-				Type: "File",
-			}
-			links, err = a.Slick.Links.AddLink(context.Background(), link)
-			if err != nil {
-				log.Printf("ERROR: Unable to create link in slick for screenshot: %s", err)
-				return
-			}
-			if len(links.Links) == 0 {
-				log.Print("ERROR: Unable to create link in slick for screenshot, list returned was empty.")
-				return
-			}
-		}
-		if link == nil {
-			for _, potential := range links.Links {
-				if potential.Id.Name == "screen" {
-					link = potential
-					break
-				}
-			}
-			if link == nil {
-				log.Print("ERROR: Unable to find or create a link for the screenshot!")
-				return
-			}
-		}
-		fmt.Printf("Starting screenshot loop\n\n")
-		for {
-			img, err := screen.CaptureScreen()
-			if err != nil {
-				fmt.Printf("error grabbing screenshot %s\n", err)
-				time.Sleep(4 * time.Second)
-				continue
-			}
-			fileName := a.Config.Slick.AgentName + "-screenshot.png"
-			file, _ := os.Create(fileName)
-			png.Encode(file, img)
-			file.Close()
-			uploadInfo := &slickqa.FileUploadInfo{
-				Id:          link.Id,
-				FileName:    fileName,
-				ContentType: "image/png",
-			}
-			uploadUrl, err := a.Slick.Links.GetUploadUrl(context.Background(), uploadInfo)
-			if err != nil {
-				log.Printf("Unable to get URL for uploading screenshot: %s", err)
-				continue
-			}
-			uploadFile(fileName, uploadUrl.Url, uploadInfo.ContentType)
-			a.Slick.Agents.UpdateScreenshotTimestamp(context.Background(), &slickqa.ScreenshotUpdateRequest{Id: &slickqa.AgentId{Company: a.Config.Company, Name: a.Config.Slick.AgentName}})
-			time.Sleep(4 * time.Second)
-		}
-	} else {
-		log.Printf("Slick grpc communication is nil, no screenshots will be taken.")
+	for _, problem := range problems {
+		fmt.Println(problem)
 	}
-
-}
-
-func (conf *PhaseConfiguration) ApplyToStatus(status *AgentStatus, staticVar *string, staticArray *[]string, staticMap *map[string]string) error {
-	if conf.Command != "" {
-		tmpfile, err := ioutil.TempFile("", "slick-agent-status-*.yml")
-		tmpFilename := tmpfile.Name()
-		if err != nil {
-			log.Printf("Unable to write temp file with status before running command %s: %s", conf.Command, err.Error())
-			return err
-		}
-		defer os.Remove(tmpFilename)
-
-		debug("Writing agent status to %s", tmpFilename)
-		content, err := json.Marshal(status)
-		if err != nil {
-			log.Printf("Unable to marshal status to json before running command %s: %s", conf.Command, err.Error())
-			return err
-		}
-		_, err = tmpfile.Write(content)
-		if err != nil {
-			log.Printf("Error writing temp file %s before running %s: %s", tmpFilename, conf.Command, err.Error())
-			return err
-		}
-		tmpfile.Close()
-
-		debug("Running Command: %s %s %#v", ProgramOptions.ShellCommand, ProgramOptions.ShellOpt, conf.Command)
-		cmd := exec.Command(ProgramOptions.ShellCommand, ProgramOptions.ShellOpt, conf.Command)
-		cmd.Env = append(os.Environ(), fmt.Sprintf("SLICK_AGENT_STATUS=%s", tmpFilename))
-		if err := cmd.Run(); err != nil {
-			log.Printf("Command %#v encountered an error: %s", conf.Command, err.Error())
-			return err
-		}
-		debug("Reading status back in from %s", tmpFilename)
-		content, err = ioutil.ReadFile(tmpFilename)
-		if err != nil {
-			log.Printf("Unable to read state from %s after running command %#v: %s", tmpFilename, conf.Command, err.Error())
-			return err
-		}
-
-		newStatus := *status
-		err = json.Unmarshal(content, &newStatus)
-		if err != nil {
-			log.Printf("Problem parsing state from %s after running command %#v: %s", tmpFilename, conf.Command, err.Error())
-			return err
-		}
-		debug("Status after command:\n%+v", newStatus)
-		*status = newStatus
-		return nil
-	} else if conf.WriteFile != "" {
-		content, err := json.Marshal(status)
-		if err != nil {
-			log.Printf("Error serializing agent status to json before writing to file %s: %s", conf.WriteFile, err.Error())
-			return err
-		}
-		err = ioutil.WriteFile(conf.WriteFile, content, 0644)
-		if err != nil {
-			log.Printf("Error writing agent status to %s: %s", conf.WriteFile, err.Error())
-			return err
-		}
-	} else if conf.HttpUrl != "" {
-		//TODO handle URL posting
-	} else if conf.StaticValue != "" {
-		if staticVar != nil {
-			*staticVar = conf.StaticValue
-		} else if staticArray != nil {
-			*staticArray = append(*staticArray, conf.StaticValue)
-		} else {
-			log.Printf("Attempted to set static value %#v but that is invalid during this phase, ignoring.", conf.StaticValue)
-			return fmt.Errorf("nil staticVar and staticArray during this phase, cannot set %#v", conf.StaticValue)
-		}
-	} else if len(conf.StaticList) > 0 {
-		if staticArray != nil {
-			*staticArray = append(*staticArray, conf.StaticList...)
+	if len(problems) > 0 {
+		if len(problems) == 1 {
+			fmt.Printf("%s has 1 problem.\n", options.ConfigurationLocation)
 		} else {
-			log.Printf("Attempted to set static list %+v but that is invalid during this phase, ignoring.", conf.StaticList)
-			return fmt.Errorf("nil staticArray, can't set value %#v during this phase", conf.StaticList)
+			fmt.Printf("%s has %d problems.\n", options.ConfigurationLocation, len(problems))
 		}
-	} else if len(conf.StaticMap) > 0 && staticMap != nil {
-		for k, v := range conf.StaticMap {
-			(*staticMap)[k] = v
-		}
-	}
-
-	return nil
-}
-
-func GetTestResult(test map[string]interface{}) string {
-	status, ok := test["status"]
-	if !ok {
-		return ""
-	}
-	result, ok := status.(string)
-	if !ok {
-		return ""
-	}
-	return result
-}
-
-func GetTestInfo(test map[string]interface{}) TestcaseInfo {
-	var retval TestcaseInfo
-	testcase, ok := test["testcase"]
-	if !ok {
-		return TestcaseInfo{}
-	}
-	testref, ok := testcase.(map[string]interface{})
-	if !ok {
-		return TestcaseInfo{}
-	}
-	testrun, ok := test["testrun"]
-	if !ok {
-		return TestcaseInfo{}
-	}
-	testrunRef, ok := testrun.(map[string]interface{})
-	if !ok {
-		retval = TestcaseInfo{
-			Id:           test["id"].(string),
-			Name:         testref["name"].(string),
-			AutomationId: testref["automationId"].(string),
-		}
-	} else {
-		retval = TestcaseInfo{
-			Id:           test["id"].(string),
-			Name:         testref["name"].(string),
-			AutomationId: testref["automationId"].(string),
-			TestrunId:    testrunRef["testrunId"].(string),
-		}
-	}
-	return retval
-}
-
-func debug(format string, v ...interface{}) {
-	if ProgramOptions.Debug {
-		log.Printf(format, v...)
-	}
-}
-
-func debugln(v ...interface{}) {
-	if ProgramOptions.Debug {
-		log.Println(v...)
+		return 1
 	}
+	fmt.Printf("%s is valid.\n", options.ConfigurationLocation)
+	return 0
 }
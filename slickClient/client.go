@@ -1,13 +1,12 @@
 package slickClient
 
 import (
-	"crypto/tls"
 	"fmt"
+	"github.com/rs/zerolog/log"
 	"github.com/slickqa/slick/slickqa"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"log"
+	"strings"
 	"time"
 )
 
@@ -20,20 +19,32 @@ type SlickClient struct {
 	Token string
 	Agents slickqa.AgentsClient
 	Links slickqa.LinksClient
+	TLS TLSOptions
+	Timeout time.Duration
+	Retries int
 	connection *grpc.ClientConn
-	jwtToken string
-	expires  time.Time
-	headers  map[string]string
+	tokens     *tokenManager
+	state      connectionState
 }
 
-func CreateClient(grpcUrl string, token string) (*SlickClient, error) {
+// CreateClient connects to slick's grpc api, securing the connection as the tls options say.  The connection
+// is kept for the life of the client: grpc re-connects when it's lost, and calls that fail because slick can't
+// be reached are retried up to retries times, see retryCalls.
+func CreateClient(grpcUrl string, token string, tlsOptions TLSOptions, timeout time.Duration, retries int) (*SlickClient, error) {
 	s := &SlickClient{
 		Token: token,
 		GrpcUrl: grpcUrl,
+		TLS: tlsOptions,
+		Timeout: timeout,
+		Retries: retries,
 	}
-	log.Printf("Connecting to slick at:" + grpcUrl)
-	conn, err := grpc.Dial(grpcUrl, grpc.WithPerRPCCredentials(SlickAuth{slickClient: s}),
-		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{ServerName: grpcUrl, InsecureSkipVerify: true})))
+	transport, err := tlsOptions.TransportCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("tls configuration error %s", err)
+	}
+	log.Info().Msgf("Connecting to slick at %s", grpcUrl)
+	conn, err := grpc.Dial(grpcUrl, grpc.WithPerRPCCredentials(SlickAuth{slickClient: s}), transport,
+		grpc.WithKeepaliveParams(keepaliveParameters), grpc.WithUnaryInterceptor(s.retryCalls))
 	if err != nil {
 		return nil, fmt.Errorf("grpc connection error %s", err)
 	}
@@ -41,39 +52,53 @@ func CreateClient(grpcUrl string, token string) (*SlickClient, error) {
 	//defer conn.Close()
 	s.Agents = slickqa.NewAgentsClient(conn)
 	s.Links = slickqa.NewLinksClient(conn)
+	s.tokens = newTokenManager(token, slickqa.NewAuthClient(conn))
+	go s.watchConnection()
 	return s, nil
 }
 
 func (s *SlickClient) Close() {
+	if s.tokens != nil {
+		s.tokens.close()
+	}
 	if s.connection != nil {
 		s.connection.Close()
 	}
 }
 
+// Authorizer provides the Authorization header for requests to slick's REST api.
+type Authorizer interface {
+	AuthorizationHeader() (string, error)
+	ClearToken()
+}
+
+// AuthorizationHeader returns the bearer token header for the jwt the api token was exchanged for, logging in
+// first if there isn't a current jwt.
+func (s *SlickClient) AuthorizationHeader() (string, error) {
+	return s.tokens.header(context.Background())
+}
+
+// ClearToken forgets the current jwt, so the next request logs in again.
+func (s *SlickClient) ClearToken() {
+	s.tokens.clear()
+}
+
+// GetRequestMetadata adds the jwt to every grpc request, except the ones to the Auth service that log in.
 func (auth SlickAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	if auth.slickClient.jwtToken == "" || time.Now().After(auth.slickClient.expires) {
-		conn, err := grpc.Dial(auth.slickClient.GrpcUrl, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
-			ServerName: auth.slickClient.GrpcUrl, InsecureSkipVerify: true})))
-		defer conn.Close()
-		if err != nil {
-			return nil, err
+	for _, u := range uri {
+		if strings.HasSuffix(u, "/slickqa.Auth") {
+			return nil, nil
 		}
-		client := slickqa.NewAuthClient(conn)
-		resp, err := client.LoginWithToken(context.Background(), &slickqa.ApiTokenLoginRequest{Token: auth.slickClient.Token})
-		if err != nil {
-			return nil, err
-		}
-		log.Printf("Got new JwtToken: %s", resp.Token)
-		auth.slickClient.jwtToken = resp.Token
-		auth.slickClient.expires = time.Now().Add(time.Duration(10 * time.Minute))
-		headers := make(map[string]string)
-		headers["Authorization"] = "Bearer " + auth.slickClient.jwtToken
-		auth.slickClient.headers = headers
 	}
-	return auth.slickClient.headers, nil
+	header, err := auth.slickClient.tokens.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"Authorization": header}, nil
 }
 
+// RequireTransportSecurity lets the token be sent over a plaintext connection only when plaintext was asked for.
 func (auth SlickAuth) RequireTransportSecurity() bool {
-	return true
+	return !auth.slickClient.TLS.Plaintext
 }
 
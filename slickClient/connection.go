@@ -0,0 +1,116 @@
+package slickClient
+
+import (
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keepaliveParameters ping slick while calls are in progress, so a connection that died without being closed
+// (a load balancer or NAT dropping it) is noticed instead of hanging the call.  Pings without calls in progress
+// aren't sent, grpc servers reject them by default.
+var keepaliveParameters = keepalive.ClientParameters{
+	Time:                time.Minute,
+	Timeout:             20 * time.Second,
+	PermitWithoutStream: false,
+}
+
+// ConnectionInfo describes the state of the grpc connection to slick.
+type ConnectionInfo struct {
+	State      string `json:"state"`
+	Reconnects int    `json:"reconnects"`
+}
+
+// connectionState keeps track of the state of the grpc connection, which grpc reconnects on its own.
+type connectionState struct {
+	mutex      sync.Mutex
+	state      connectivity.State
+	connected  bool
+	reconnects int
+}
+
+// Connection returns the current state of the connection to slick, and how many times it was re-established.
+func (s *SlickClient) Connection() ConnectionInfo {
+	s.state.mutex.Lock()
+	defer s.state.mutex.Unlock()
+	return ConnectionInfo{State: s.state.state.String(), Reconnects: s.state.reconnects}
+}
+
+// watchConnection follows the state of the connection until it is closed, logging when it is lost and
+// re-established.
+func (s *SlickClient) watchConnection() {
+	state := s.connection.GetState()
+	for {
+		s.state.mutex.Lock()
+		previous := s.state.state
+		s.state.state = state
+		if state == connectivity.Ready {
+			if s.state.connected {
+				s.state.reconnects++
+				log.Info().Msgf("Re-connected to slick at %s", s.GrpcUrl)
+			}
+			s.state.connected = true
+		} else if state == connectivity.TransientFailure && previous != connectivity.TransientFailure {
+			log.Warn().Msgf("Connection to slick at %s failed, grpc will keep trying to re-connect.", s.GrpcUrl)
+		}
+		s.state.mutex.Unlock()
+		if state == connectivity.Shutdown {
+			return
+		}
+		s.connection.WaitForStateChange(context.Background(), state)
+		state = s.connection.GetState()
+	}
+}
+
+// retryCalls is the interceptor every grpc call to slick goes through.  Calls without a deadline get the
+// client's timeout.  Calls that fail because slick can't be reached are retried with backoff, a call that
+// wasn't authenticated is retried once with a fresh jwt, and any other error is returned straight away since
+// sending the same request again won't change the answer.
+func (s *SlickClient) retryCalls(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	refreshedToken := false
+	retries := 0
+	for {
+		callContext, cancel := ctx, context.CancelFunc(func() {})
+		if _, hasDeadline := ctx.Deadline(); !hasDeadline && s.Timeout > 0 {
+			callContext, cancel = context.WithTimeout(ctx, s.Timeout)
+		}
+		err := invoker(callContext, method, req, reply, cc, opts...)
+		cancel()
+
+		switch status.Code(err) {
+		case codes.Unauthenticated:
+			if !refreshedToken && !strings.HasPrefix(method, "/slickqa.Auth/") {
+				// with the jwt cleared, GetRequestMetadata logs in again when the call is invoked once more.  Auth
+				// calls aren't repeated, an Unauthenticated from logging in means the api key itself is wrong.
+				s.tokens.clear()
+				refreshedToken = true
+				continue
+			}
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			if retries < s.Retries && ctx.Err() == nil {
+				retries++
+				delay := backoff(retries)
+				log.Warn().Msgf("Retrying %s in %s after: %s", method, delay, err)
+				// don't wait for grpc's own backoff to try connecting again
+				cc.ResetConnectBackoff()
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return err
+				case <-timer.C:
+				}
+				continue
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,53 @@
+package slickClient
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+)
+
+// Queues are the result queues an agent can take tests from, by the name slick.queue gives them.  Slick's grpc
+// api doesn't have a results queue yet, so the REST queue is the only one.
+var Queues = []string{"rest"}
+
+// ResultQueue hands out the results an agent runs.
+type ResultQueue interface {
+	// NextResult takes the next result matching the query off the queue for the agent.  A nil result with a
+	// nil error means the queue had nothing for the agent.  A result that was taken off the queue but can't
+	// be used is returned as an *UnusableResultError, so it can still be finished.
+	NextResult(ctx context.Context, agentName string, query map[string]interface{}) (*Result, error)
+}
+
+// UnusableResultError is returned by a ResultQueue for a result it took off the queue that ParseResult
+// rejected.  The id is empty when the result didn't have one.
+type UnusableResultError struct {
+	Id  string
+	Err error
+}
+
+func (err *UnusableResultError) Error() string {
+	return err.Err.Error()
+}
+
+// NextResult takes the next result off slick's REST queue.
+func (s *SlickRestClient) NextResult(ctx context.Context, agentName string, query map[string]interface{}) (*Result, error) {
+	raw, err := s.RequestResultFromQueue(ctx, agentName, query)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	result, err := ParseResult(raw)
+	if err != nil {
+		id, _ := raw["id"].(string)
+		return nil, &UnusableResultError{Id: id, Err: err}
+	}
+	return result, nil
+}
+
+// CreateResultQueue returns the queue with the given name, one of Queues, taking results from the REST api
+// through rest.  An empty name is the REST queue.
+func CreateResultQueue(name string, rest *SlickRestClient) (ResultQueue, error) {
+	switch name {
+	case "", "rest":
+		return rest, nil
+	}
+	return nil, fmt.Errorf("unknown queue %#v, use one of %v", name, Queues)
+}
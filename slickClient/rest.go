@@ -0,0 +1,201 @@
+package slickClient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultRequestTimeout = 30 * time.Second
+	DefaultRetries        = 3
+	initialBackoff        = 500 * time.Millisecond
+	maxBackoff            = 10 * time.Second
+)
+
+// SlickRestClient talks to the REST api of slick.  Requests that fail to reach slick, or get a 5xx response,
+// are retried with exponential backoff, except that a request that isn't safe to repeat is only retried when
+// it can't have been acted on: it never reached slick, or slick answered 503.  When Auth is set every request
+// carries its Authorization header, and a 401 response gets the request sent once more with a fresh token.
+type SlickRestClient struct {
+	BaseUrl string
+	Retries int
+	Auth    Authorizer
+	client  *http.Client
+}
+
+// HttpStatusError is returned when slick responds with a status code the request didn't expect.
+type HttpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (err *HttpStatusError) Error() string {
+	return fmt.Sprintf("http status code was %d", err.StatusCode)
+}
+
+func CreateRestClient(baseUrl string, auth Authorizer, timeout time.Duration, retries int) *SlickRestClient {
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return &SlickRestClient{
+		BaseUrl: baseUrl,
+		Retries: retries,
+		Auth:    auth,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// RequestResultFromQueue asks slick for the next result the agent should run.  A nil result with a nil error
+// means the queue had nothing for the agent.  Every request takes a result off the queue, so it's only retried
+// when slick can't have given one out.
+func (s *SlickRestClient) RequestResultFromQueue(ctx context.Context, agentName string, query map[string]interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	status, body, err := s.do(ctx, "POST", s.BaseUrl+"/api/results/queue/"+agentName, content, false)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNoContent || status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, &HttpStatusError{StatusCode: status, Body: string(body)}
+	}
+	var result map[string]interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse json from slick: %s", err)
+		}
+	}
+	return result, nil
+}
+
+// UpdateResult applies the fields in update to the result with the given id.
+func (s *SlickRestClient) UpdateResult(ctx context.Context, id string, update map[string]interface{}) error {
+	content, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	status, body, err := s.do(ctx, "PUT", s.BaseUrl+"/api/results/"+id, content, true)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return &HttpStatusError{StatusCode: status, Body: string(body)}
+	}
+	return nil
+}
+
+// do sends a json request, retrying on transport errors and 5xx responses, and returns the status code and
+// body of the last response.  A request that isn't idempotent is only retried when it never reached slick or
+// got a 503.  Waiting to retry stops when ctx is cancelled, but a request that was sent isn't cancelled with
+// it, since slick may already have acted on it.
+func (s *SlickRestClient) do(ctx context.Context, method string, url string, content []byte, idempotent bool) (int, []byte, error) {
+	var lastErr error
+	refreshedToken := false
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt)
+			log.Warn().Msgf("Retrying %s %s in %s after: %s", method, url, delay, lastErr)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return 0, nil, lastErr
+			case <-timer.C:
+			}
+		}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(content))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := Do(s.client, req, s.Auth)
+		if err != nil {
+			lastErr = err
+			if idempotent || notSent(err) {
+				continue
+			}
+			return 0, nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			if idempotent {
+				continue
+			}
+			return 0, nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && s.Auth != nil && !refreshedToken {
+			// the jwt may have expired early or been revoked, which doesn't count as a retry
+			s.Auth.ClearToken()
+			refreshedToken = true
+			attempt--
+			lastErr = &HttpStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+			continue
+		}
+		if resp.StatusCode >= 500 && (idempotent || resp.StatusCode == http.StatusServiceUnavailable) {
+			lastErr = &HttpStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+			continue
+		}
+		return resp.StatusCode, body, nil
+	}
+	return 0, nil, lastErr
+}
+
+// loginError is returned by Do when it couldn't log in, before the request was sent.
+type loginError struct {
+	err error
+}
+
+func (err *loginError) Error() string {
+	return fmt.Sprintf("unable to log in to slick: %s", err.err)
+}
+
+// notSent says whether err from Do means the request never reached the server: logging in or connecting to it
+// failed.
+func notSent(err error) bool {
+	if _, ok := err.(*loginError); ok {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Do sends the request with client, adding the Authorization header from auth when it isn't nil.
+func Do(client *http.Client, req *http.Request, auth Authorizer) (*http.Response, error) {
+	if auth != nil {
+		header, err := auth.AuthorizationHeader()
+		if err != nil {
+			return nil, &loginError{err: err}
+		}
+		req.Header.Set("Authorization", header)
+	}
+	return client.Do(req)
+}
+
+// backoff returns how long to wait before the given retry, doubling every attempt up to maxBackoff, with
+// jitter so a lab full of agents doesn't retry in lock step.
+func backoff(attempt int) time.Duration {
+	delay := initialBackoff << uint(attempt-1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
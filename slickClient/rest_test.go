@@ -0,0 +1,75 @@
+package slickClient
+
+import (
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		delay    time.Duration
+		requests int32
+	}{
+		{"queue 500", "POST", 500, 0, 1},
+		{"queue 503", "POST", 503, 0, 3},
+		{"queue timeout after sending", "POST", 200, 300 * time.Millisecond, 1},
+		{"update 500", "PUT", 500, 0, 3},
+		{"update timeout", "PUT", 200, 300 * time.Millisecond, 3},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			time.Sleep(test.delay)
+			w.WriteHeader(test.status)
+		}))
+		client := CreateRestClient(server.URL, nil, 100*time.Millisecond, 2)
+		var err error
+		if test.method == "POST" {
+			_, err = client.RequestResultFromQueue(context.Background(), "agent", nil)
+		} else {
+			err = client.UpdateResult(context.Background(), "id", nil)
+		}
+		server.Close()
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if got := atomic.LoadInt32(&requests); got != test.requests {
+			t.Errorf("%s: expected %d requests, slick got %d", test.name, test.requests, got)
+		}
+	}
+}
+
+func TestRestRetriesWhenSlickIsDown(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	client := CreateRestClient(url, nil, 100*time.Millisecond, 1)
+	start := time.Now()
+	if _, err := client.RequestResultFromQueue(context.Background(), "agent", nil); err == nil || !notSent(err) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+	if took := time.Since(start); took < initialBackoff/2 {
+		t.Errorf("a queue request that never reached slick wasn't retried, it took %s", took)
+	}
+
+	// shutting down stops waiting to retry
+	client = CreateRestClient(url, nil, 100*time.Millisecond, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if _, err := client.RequestResultFromQueue(ctx, "agent", nil); err == nil {
+		t.Error("expected an error")
+	}
+	if took := time.Since(start); took > initialBackoff/2 {
+		t.Errorf("retries took %s after the context was cancelled", took)
+	}
+}
@@ -0,0 +1,208 @@
+package slickClient
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Result is a result from slick's queue that the agent was given to run.  The json slick sent is kept in Raw,
+// and that is what command phases see in the status file, so fields the agent doesn't know about make it
+// through unchanged.  Status and Reason are written back to it whenever the result is serialized.
+type Result struct {
+	Id           string
+	Testcase     ResultReference
+	Testrun      ResultReference
+	Project      ResultReference
+	Release      ResultReference
+	Build        ResultReference
+	Attributes   map[string]string
+	Requirements []string
+	Status       string
+	Reason       string
+	Raw          map[string]interface{}
+}
+
+// ResultReference is one of the references a result has to the things it belongs to.
+type ResultReference struct {
+	Id           string
+	Name         string
+	AutomationId string
+}
+
+// ParseResult builds a result from the json object slick returned, returning an error rather than panicking
+// when a field is missing or has the wrong type.
+func ParseResult(raw map[string]interface{}) (*Result, error) {
+	result := &Result{Raw: raw}
+	var err error
+	if result.Id, err = requiredString(raw, "id"); err != nil {
+		return nil, err
+	}
+	testcase, err := object(raw, "testcase")
+	if err != nil {
+		return nil, err
+	}
+	if testcase == nil {
+		return nil, fmt.Errorf("result %s has no testcase", result.Id)
+	}
+	if result.Testcase, err = parseReference(testcase, "testcaseId"); err != nil {
+		return nil, fmt.Errorf("testcase of result %s: %s", result.Id, err)
+	}
+	if result.Testcase.AutomationId, err = optionalString(testcase, "automationId"); err != nil {
+		return nil, fmt.Errorf("testcase of result %s: %s", result.Id, err)
+	}
+	references := []struct {
+		key       string
+		idKey     string
+		reference *ResultReference
+	}{
+		{"testrun", "testrunId", &result.Testrun},
+		{"project", "id", &result.Project},
+		{"release", "releaseId", &result.Release},
+		{"build", "buildId", &result.Build},
+	}
+	for _, ref := range references {
+		value, err := object(raw, ref.key)
+		if err != nil {
+			return nil, fmt.Errorf("result %s: %s", result.Id, err)
+		}
+		if value != nil {
+			if *ref.reference, err = parseReference(value, ref.idKey); err != nil {
+				return nil, fmt.Errorf("%s of result %s: %s", ref.key, result.Id, err)
+			}
+		}
+	}
+	if result.Attributes, err = stringMap(raw, "attributes"); err != nil {
+		return nil, fmt.Errorf("result %s: %s", result.Id, err)
+	}
+	if result.Requirements, err = stringList(raw, "requirements"); err != nil {
+		return nil, fmt.Errorf("result %s: %s", result.Id, err)
+	}
+	if result.Status, err = optionalString(raw, "status"); err != nil {
+		return nil, fmt.Errorf("result %s: %s", result.Id, err)
+	}
+	if result.Reason, err = optionalString(raw, "reason"); err != nil {
+		return nil, fmt.Errorf("result %s: %s", result.Id, err)
+	}
+	return result, nil
+}
+
+func (result *Result) UnmarshalJSON(content []byte) error {
+	var raw map[string]interface{}
+	err := json.Unmarshal(content, &raw)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseResult(raw)
+	if err != nil {
+		return err
+	}
+	*result = *parsed
+	return nil
+}
+
+// MarshalJSON writes the raw json slick sent, with the id, status and reason of the result.
+func (result *Result) MarshalJSON() ([]byte, error) {
+	raw := make(map[string]interface{}, len(result.Raw)+2)
+	for k, v := range result.Raw {
+		raw[k] = v
+	}
+	raw["id"] = result.Id
+	if result.Status != "" {
+		raw["status"] = result.Status
+	}
+	if result.Reason != "" {
+		raw["reason"] = result.Reason
+	}
+	return json.Marshal(raw)
+}
+
+// TestcaseInfo identifies a result in logs and file uploads.
+type TestcaseInfo struct {
+	Id           string
+	Name         string
+	AutomationId string
+	TestrunId    string
+}
+
+// TestcaseInfo returns the information used to identify the result in logs and file uploads.
+func (result *Result) TestcaseInfo() TestcaseInfo {
+	return TestcaseInfo{
+		Id:           result.Id,
+		Name:         result.Testcase.Name,
+		AutomationId: result.Testcase.AutomationId,
+		TestrunId:    result.Testrun.Id,
+	}
+}
+
+func parseReference(value map[string]interface{}, idKey string) (ResultReference, error) {
+	var reference ResultReference
+	var err error
+	if reference.Id, err = optionalString(value, idKey); err != nil {
+		return reference, err
+	}
+	reference.Name, err = optionalString(value, "name")
+	return reference, err
+}
+
+func requiredString(value map[string]interface{}, key string) (string, error) {
+	s, err := optionalString(value, key)
+	if err == nil && s == "" {
+		err = fmt.Errorf("%s is missing", key)
+	}
+	return s, err
+}
+
+func optionalString(value map[string]interface{}, key string) (string, error) {
+	switch v := value[key].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("%s should be a string, not %#v", key, v)
+	}
+}
+
+func object(value map[string]interface{}, key string) (map[string]interface{}, error) {
+	switch v := value[key].(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("%s should be an object, not %#v", key, v)
+	}
+}
+
+func stringMap(value map[string]interface{}, key string) (map[string]string, error) {
+	values, err := object(value, key)
+	if err != nil || values == nil {
+		return nil, err
+	}
+	strings := make(map[string]string, len(values))
+	for k, v := range values {
+		if v != nil {
+			strings[k] = fmt.Sprint(v)
+		}
+	}
+	return strings, nil
+}
+
+func stringList(value map[string]interface{}, key string) ([]string, error) {
+	switch v := value[key].(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		strings := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s should be a list of strings, not %#v", key, v)
+			}
+			strings = append(strings, s)
+		}
+		return strings, nil
+	default:
+		return nil, fmt.Errorf("%s should be a list, not %#v", key, v)
+	}
+}
@@ -0,0 +1,107 @@
+package slickClient
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+		result  *Result
+	}{
+		{
+			name:    "complete",
+			content: `{"id": "r1", "testcase": {"testcaseId": "t1", "name": "login", "automationId": "tests.login"}, "testrun": {"testrunId": "tr1", "name": "nightly"}, "project": {"id": "p1", "name": "app"}, "release": {"releaseId": "rl1", "name": "1.0"}, "build": {"buildId": "b1", "name": "42"}, "attributes": {"os": "android", "api": 29, "skip": null}, "requirements": ["android"], "status": "NO_RESULT", "reason": "queued"}`,
+			result: &Result{
+				Id:           "r1",
+				Testcase:     ResultReference{Id: "t1", Name: "login", AutomationId: "tests.login"},
+				Testrun:      ResultReference{Id: "tr1", Name: "nightly"},
+				Project:      ResultReference{Id: "p1", Name: "app"},
+				Release:      ResultReference{Id: "rl1", Name: "1.0"},
+				Build:        ResultReference{Id: "b1", Name: "42"},
+				Attributes:   map[string]string{"os": "android", "api": "29"},
+				Requirements: []string{"android"},
+				Status:       "NO_RESULT",
+				Reason:       "queued",
+			},
+		},
+		{
+			name:    "only what's required",
+			content: `{"id": "r1", "testcase": {}}`,
+			result:  &Result{Id: "r1"},
+		},
+		{
+			name:    "null references",
+			content: `{"id": "r1", "testcase": {"name": null}, "testrun": null, "project": null, "release": null, "build": null, "attributes": null, "requirements": null, "status": null}`,
+			result:  &Result{Id: "r1"},
+		},
+		{name: "missing id", content: `{"testcase": {}}`, err: "id is missing"},
+		{name: "null id", content: `{"id": null, "testcase": {}}`, err: "id is missing"},
+		{name: "numeric id", content: `{"id": 12, "testcase": {}}`, err: "id should be a string, not 12"},
+		{name: "missing testcase", content: `{"id": "r1"}`, err: "result r1 has no testcase"},
+		{name: "null testcase", content: `{"id": "r1", "testcase": null}`, err: "result r1 has no testcase"},
+		{name: "testcase that isn't an object", content: `{"id": "r1", "testcase": "login"}`, err: `testcase should be an object, not "login"`},
+		{name: "numeric testcase name", content: `{"id": "r1", "testcase": {"name": 3}}`, err: "testcase of result r1: name should be a string, not 3"},
+		{name: "testrun that isn't an object", content: `{"id": "r1", "testcase": {}, "testrun": []}`, err: "result r1: testrun should be an object, not []interface {}{}"},
+		{name: "numeric testrun id", content: `{"id": "r1", "testcase": {}, "testrun": {"testrunId": 4}}`, err: "testrun of result r1: testrunId should be a string, not 4"},
+		{name: "requirements that aren't strings", content: `{"id": "r1", "testcase": {}, "requirements": ["android", 3]}`, err: `result r1: requirements should be a list of strings, not []interface {}{"android", 3}`},
+		{name: "requirements that aren't a list", content: `{"id": "r1", "testcase": {}, "requirements": "android"}`, err: `result r1: requirements should be a list, not "android"`},
+		{name: "attributes that aren't an object", content: `{"id": "r1", "testcase": {}, "attributes": ["os"]}`, err: `result r1: attributes should be an object, not []interface {}{"os"}`},
+	}
+	for _, test := range tests {
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(test.content), &raw); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		result, err := ParseResult(raw)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %s, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		test.result.Raw = raw
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.result, result)
+		}
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	content := `{"id": "r1", "testcase": {"testcaseId": "t1", "name": "login", "steps": [1, 2]}, "config": {"browser": "firefox"}, "status": "NO_RESULT"}`
+	var result Result
+	if err := json.Unmarshal([]byte(content), &result); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	result.Status = "FAIL"
+	result.Reason = "assertion failed"
+	written, err := json.Marshal(&result)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var document map[string]interface{}
+	json.Unmarshal(written, &document)
+	expected := map[string]interface{}{
+		"id":       "r1",
+		"testcase": map[string]interface{}{"testcaseId": "t1", "name": "login", "steps": []interface{}{1.0, 2.0}},
+		"config":   map[string]interface{}{"browser": "firefox"},
+		"status":   "FAIL",
+		"reason":   "assertion failed",
+	}
+	if !reflect.DeepEqual(document, expected) {
+		t.Errorf("expected %s, got %s", expected, written)
+	}
+
+	var invalid Result
+	if err := json.Unmarshal([]byte(`{"id": 12}`), &invalid); err == nil {
+		t.Error("expected an error for a numeric id")
+	}
+}
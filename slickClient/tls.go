@@ -0,0 +1,68 @@
+package slickClient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+)
+
+// TLSOptions control how the connection to slick's grpc api is secured.  The zero value verifies the server's
+// certificate against the system's certificate authorities.
+type TLSOptions struct {
+	// CAFile is a pem bundle of certificate authorities to trust instead of the system's.
+	CAFile string `yaml:"ca-file,omitempty"`
+	// CertFile and KeyFile are the client certificate and key for mutual tls.
+	CertFile string `yaml:"cert-file,omitempty"`
+	KeyFile  string `yaml:"key-file,omitempty"`
+	// ServerName overrides the name the server's certificate is checked against, which is otherwise the host
+	// of the grpc url.
+	ServerName string `yaml:"server-name,omitempty"`
+	// Insecure turns off verification of the server's certificate.
+	Insecure bool `yaml:"insecure,omitempty"`
+	// Plaintext connects without tls at all, for local test servers.
+	Plaintext bool `yaml:"plaintext,omitempty"`
+}
+
+// TransportCredentials returns the dial option securing a connection with these options.
+func (options TLSOptions) TransportCredentials() (grpc.DialOption, error) {
+	if options.Plaintext {
+		return grpc.WithInsecure(), nil
+	}
+	config, err := options.Config()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// Config builds the tls configuration for these options, reading the certificate files they refer to.
+func (options TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.Insecure,
+	}
+	if options.CAFile != "" {
+		content, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca-file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in ca-file %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, fmt.Errorf("cert-file and key-file have to be set together for mutual tls")
+		}
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
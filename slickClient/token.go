@@ -0,0 +1,164 @@
+package slickClient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slickqa/slick/slickqa"
+	"golang.org/x/net/context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTokenLifetime is how long a jwt is assumed to last when its expiration can't be read.
+	DefaultTokenLifetime = 10 * time.Minute
+	// tokenRenewalMargin is the most time before a jwt expires that it is renewed in the background.
+	tokenRenewalMargin = time.Minute
+	// tokenRetryDelay is how long to wait before trying again when renewing a jwt failed.
+	tokenRetryDelay = 30 * time.Second
+	loginTimeout    = 30 * time.Second
+)
+
+// tokenManager exchanges the api token for a jwt, and renews the jwt before it expires so requests don't have
+// to wait for a login.  It is safe to use from several goroutines.
+type tokenManager struct {
+	apiToken string
+	auth     slickqa.AuthClient
+	mutex    sync.Mutex
+	jwt      string
+	expires  time.Time
+	renewAt  time.Time
+	loggedIn chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTokenManager(apiToken string, auth slickqa.AuthClient) *tokenManager {
+	tokens := &tokenManager{
+		apiToken: apiToken,
+		auth:     auth,
+		loggedIn: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	go tokens.renew()
+	return tokens
+}
+
+// header returns the Authorization header for the current jwt, logging in first if there isn't one or it
+// has expired.
+func (tokens *tokenManager) header(ctx context.Context) (string, error) {
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+	if tokens.jwt == "" || !time.Now().Before(tokens.expires) {
+		err := tokens.login(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "Bearer " + tokens.jwt, nil
+}
+
+// login exchanges the api token for a new jwt, the mutex must be held by the caller.
+func (tokens *tokenManager) login(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+	resp, err := tokens.auth.LoginWithToken(ctx, &slickqa.ApiTokenLoginRequest{Token: tokens.apiToken})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expires, err := tokenExpiration(resp.Token)
+	if err != nil {
+		log.Warn().Msgf("Assuming the jwt from slick expires in %s, unable to read its expiration: %s", DefaultTokenLifetime, err)
+		expires = now.Add(DefaultTokenLifetime)
+	}
+	margin := expires.Sub(now) / 10
+	if margin > tokenRenewalMargin {
+		margin = tokenRenewalMargin
+	}
+	tokens.jwt = resp.Token
+	tokens.expires = expires
+	tokens.renewAt = expires.Add(-margin)
+	log.Info().Msgf("Logged in to slick, the jwt expires at %s.", expires.Format(time.RFC3339))
+	select {
+	case tokens.loggedIn <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// clear forgets the current jwt, so the next request logs in again.
+func (tokens *tokenManager) clear() {
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+	tokens.jwt = ""
+}
+
+// renew logs in again shortly before the current jwt expires, until the manager is closed.  It only keeps an
+// existing login fresh, the first login happens when a request needs it.
+func (tokens *tokenManager) renew() {
+	for {
+		tokens.mutex.Lock()
+		wait := tokenRetryDelay
+		if tokens.jwt != "" {
+			wait = time.Until(tokens.renewAt)
+		}
+		tokens.mutex.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-tokens.stop:
+			timer.Stop()
+			return
+		case <-tokens.loggedIn:
+			// work out the wait again for the new jwt
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		tokens.mutex.Lock()
+		if tokens.jwt != "" && !time.Now().Before(tokens.renewAt) {
+			err := tokens.login(context.Background())
+			if err != nil {
+				log.Error().Msgf("Error renewing the jwt for slick, trying again in %s: %s", tokenRetryDelay, err)
+				tokens.renewAt = time.Now().Add(tokenRetryDelay)
+			}
+		}
+		tokens.mutex.Unlock()
+	}
+}
+
+func (tokens *tokenManager) close() {
+	tokens.stopOnce.Do(func() { close(tokens.stop) })
+}
+
+// tokenExpiration reads the exp claim of a jwt.  The signature isn't checked, slick does that.
+func tokenExpiration(jwt string) (time.Time, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("jwt doesn't have 3 parts")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Expires *json.Number `json:"exp"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Expires == nil {
+		return time.Time{}, errors.New("jwt has no exp claim")
+	}
+	seconds, err := claims.Expires.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(seconds), 0), nil
+}